@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often to check for certificates approaching expiry, in addition to
+// checking at startup and after each reload.
+const certificateCheckInterval = time.Hour
+
+// Keeps track of the expiry warnings which have already been logged, so
+// that each is only logged once per certificate.
+type certMonitor struct {
+	warned map[string]int
+}
+
+func newCertMonitor() *certMonitor {
+	return &certMonitor{warned: make(map[string]int)}
+}
+
+// Log a warning for each certificate in rc which has crossed one of the
+// ExpiryWarningDays thresholds, or expired, since the last check.
+// Self-signed certificates within AutoRenewDays of expiry are
+// renewed if AutoCertificate is set, in which case a copy of rc using the
+// new certificates is returned.  Otherwise nil is returned.
+func (cm *certMonitor) check(rc *runningConfig) *runningConfig {
+	config := rc.sysConfig
+	var renewed *runningConfig
+	for _, kp := range getKeypairs(config) {
+		key := keypairKey(kp.certPath, kp.keyPath)
+		cert := rc.certs.byKeypair[key]
+		if cert == nil {
+			continue
+		}
+		remaining := time.Until(cert.Leaf.NotAfter)
+
+		// Renew auto-generated certificates in good time
+		if config.AutoCertificate && config.AutoRenewDays > 0 && remaining <= days(config.AutoRenewDays) && isSelfSigned(cert.Leaf) {
+			newCert, err := renewCertificate(cert, kp.certPath, kp.hostnames, config.AutoCertificateDays)
+			if err == nil {
+				if renewed == nil {
+					renewed = rc.withCertificates()
+				}
+				renewed.certs.replace(cert, newCert)
+				continue
+			}
+			log.Println("Error renewing TLS certificate " + kp.certPath + ": " + err.Error())
+		}
+
+		// Otherwise warn about the most urgent threshold crossed
+		threshold := 0
+		for _, warnDays := range config.ExpiryWarningDays {
+			if warnDays > 0 && remaining <= days(warnDays) && (threshold == 0 || warnDays < threshold) {
+				threshold = warnDays
+			}
+		}
+		if remaining <= 0 {
+			threshold = -1
+		}
+		fingerprint := getCertFingerprint(cert.Leaf)
+		if threshold == 0 || cm.warned[fingerprint] == threshold {
+			continue
+		}
+		cm.warned[fingerprint] = threshold
+		if threshold == -1 {
+			log.Println("Hey, your certificate " + kp.certPath + " expired on " + cert.Leaf.NotAfter.String() + "!!!")
+		} else {
+			log.Println("TLS certificate " + kp.certPath + " expires in less than " + strconv.Itoa(threshold) + " days, on " + cert.Leaf.NotAfter.String() + ".")
+		}
+	}
+	return renewed
+}
+
+// Return a copy of rc whose certificates can be replaced without affecting
+// rc itself.
+func (rc *runningConfig) withCertificates() *runningConfig {
+	newRC := *rc
+	newRC.certs.byHostname = make(map[string]*tls.Certificate)
+	for hostname, cert := range rc.certs.byHostname {
+		newRC.certs.byHostname[hostname] = cert
+	}
+	newRC.certs.byKeypair = make(map[string]*tls.Certificate)
+	for key, cert := range rc.certs.byKeypair {
+		newRC.certs.byKeypair[key] = cert
+	}
+	newRC.tlsConfig = rc.tlsConfig.Clone()
+	newRC.tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return newRC.certs.get(hello.ServerName), nil
+	}
+	return &newRC
+}
+
+// Use newCert wherever oldCert was used.
+func (sc *ServerCertificates) replace(oldCert *tls.Certificate, newCert *tls.Certificate) {
+	if sc.defaultCert == oldCert {
+		sc.defaultCert = newCert
+	}
+	for hostname, cert := range sc.byHostname {
+		if cert == oldCert {
+			sc.byHostname[hostname] = newCert
+		}
+	}
+	for key, cert := range sc.byKeypair {
+		if cert == oldCert {
+			sc.byKeypair[key] = newCert
+		}
+	}
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return false
+	}
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// Create a new self-signed certificate for hostnames using the same key as
+// cert, so that clients which have pinned the key continue to trust it, and
+// try to save it to certPath.  If it can't be saved, e.g. due to having
+// dropped privileges, the new certificate is used anyway and this is
+// logged.
+func renewCertificate(cert *tls.Certificate, certPath string, hostnames []string, validDays int) (*tls.Certificate, error) {
+	certDer, err := selfSign(hostnames, cert.Leaf.PublicKey, cert.PrivateKey, validDays)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(certDer)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(leaf.RawSubjectPublicKeyInfo, cert.Leaf.RawSubjectPublicKeyInfo) {
+		return nil, errors.New("Renewed certificate has a different public key")
+	}
+	newCert := &tls.Certificate{
+		Certificate: [][]byte{certDer},
+		PrivateKey:  cert.PrivateKey,
+		Leaf:        leaf,
+	}
+
+	// Replace the file atomically, so it's never seen half written
+	tmpPath := certPath + ".new"
+	os.Remove(tmpPath)
+	err = writePEMFile(tmpPath, "CERTIFICATE", certDer, 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, certPath)
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}
+	if err != nil {
+		log.Println("Could not save renewed TLS certificate " + certPath + ", it will be renewed again after restarting: " + err.Error())
+	}
+	log.Println("Renewed self-signed certificate " + certPath + " for " + strings.Join(hostnames, ", ") + ", valid until " + leaf.NotAfter.String() + ", with fingerprint " + getCertFingerprint(leaf) + ".")
+	return newCert, nil
+}
+
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
@@ -2,17 +2,180 @@ package main
 
 import (
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
 	"net/url"
+	"os"
 	"regexp"
+	"strings"
 	"time"
 )
 
-func enforceCertificateValidity(clientCerts []*x509.Certificate, conn net.Conn, logEntry *LogEntry) {
-	// This will fail if any of multiple certs are invalid
-	// Maybe we should just require one valid?
+type ServerCertificates struct {
+	defaultCert *tls.Certificate
+	byHostname  map[string]*tls.Certificate
+	byKeypair   map[string]*tls.Certificate
+}
+
+// Return the certificate to present for the given SNI hostname, falling
+// back to the main certificate for unknown or missing names.
+func (sc *ServerCertificates) get(hostname string) *tls.Certificate {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	cert, present := sc.byHostname[hostname]
+	if present {
+		return cert
+	}
+	return sc.defaultCert
+}
+
+func loadServerCertificates(config SysConfig) (ServerCertificates, error) {
+	var sc ServerCertificates
+	sc.byHostname = make(map[string]*tls.Certificate)
+
+	cert, err := loadServerCertificate(config.CertPath, config.KeyPath, []string{config.Hostname})
+	if err != nil {
+		return sc, err
+	}
+	sc.defaultCert = &cert
+	sc.byHostname[config.Hostname] = &cert
+
+	// Virtual hosts which share a keypair also share a tls.Certificate
+	loaded := make(map[string]*tls.Certificate)
+	loaded[keypairKey(config.CertPath, config.KeyPath)] = &cert
+	for _, vhost := range config.VirtualHosts {
+		key := keypairKey(vhost.CertPath, vhost.KeyPath)
+		vhostCert, present := loaded[key]
+		if !present {
+			newCert, err := loadServerCertificate(vhost.CertPath, vhost.KeyPath, vhost.Hostnames)
+			if err != nil {
+				return sc, err
+			}
+			vhostCert = &newCert
+			loaded[key] = vhostCert
+		} else {
+			err = checkServerCertificate(vhostCert.Leaf, vhost.CertPath, vhost.Hostnames)
+			if err != nil {
+				return sc, err
+			}
+		}
+		for _, hostname := range vhost.Hostnames {
+			sc.byHostname[hostname] = vhostCert
+		}
+	}
+	sc.byKeypair = loaded
+	return sc, nil
+}
+
+func keypairKey(certPath string, keyPath string) string {
+	return certPath + "\x00" + keyPath
+}
+
+func loadServerCertificate(certPath string, keyPath string, hostnames []string) (tls.Certificate, error) {
+	var cert tls.Certificate
+
+	// Check key file permissions first
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		log.Println("Error opening TLS key file: " + err.Error())
+		return cert, err
+	}
+	if uint64(info.Mode().Perm())&0444 == 0444 {
+		log.Println("Refusing to use world-readable TLS key file " + keyPath)
+		return cert, errors.New("World-readable TLS key file")
+	}
+
+	// Check certificate hostname matches server hostname
+	certBytes, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		log.Println("Error reading TLS certificate file: " + err.Error())
+		return cert, err
+	}
+	certDer, _ := pem.Decode(certBytes)
+	if certDer == nil {
+		log.Println("Error decoding TLS certificate file " + certPath)
+		return cert, errors.New("Could not decode TLS certificate file")
+	}
+	certx509, err := x509.ParseCertificate(certDer.Bytes)
+	if err != nil {
+		log.Println("Error parsing TLS certificate: " + err.Error())
+		return cert, err
+	}
+	err = checkServerCertificate(certx509, certPath, hostnames)
+	if err != nil {
+		return cert, err
+	}
+
+	// Load certificate and private key
+	cert, err = tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		log.Println("Error loading TLS keypair: " + err.Error())
+		return cert, err
+	}
+	cert.Leaf = certx509
+	return cert, nil
+}
+
+func checkServerCertificate(certx509 *x509.Certificate, certPath string, hostnames []string) error {
+	for _, hostname := range hostnames {
+		err := certx509.VerifyHostname(hostname)
+		if err != nil {
+			log.Println("Invalid TLS certificate " + certPath + ": " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// How strictly each certificate validity policy checks client certificates.
+var certificateValidityStrictness = map[string]int{
+	"ignore": 0,
+	"leaf":   1,
+	"chain":  2,
+}
+
+func validCertificateValidity(policy string) bool {
+	_, present := certificateValidityStrictness[policy]
+	return present
+}
+
+// Return the validity policy for requests for path, which is the strictest
+// of the policies for the CertificateValidityZones matching path, or
+// CertificateValidity if there are none.
+func getCertificateValidity(path string, config UserConfig) string {
+	policy := ""
+	for zone, zonePolicy := range config.CertificateValidityZones {
+		matched, err := regexp.MatchString(zone, path)
+		if !matched || err != nil {
+			continue
+		}
+		if policy == "" || certificateValidityStrictness[zonePolicy] > certificateValidityStrictness[policy] {
+			policy = zonePolicy
+		}
+	}
+	if policy == "" {
+		policy = config.CertificateValidity
+	}
+	return policy
+}
+
+func enforceCertificateValidity(URL *url.URL, clientCerts []*x509.Certificate, config UserConfig, conn net.Conn, logEntry *LogEntry) {
+	// Depending on the policy, check the whole chain, only the client's
+	// own certificate, or nothing at all
+	switch getCertificateValidity(URL.Path, config) {
+	case "ignore":
+		return
+	case "leaf":
+		if len(clientCerts) > 1 {
+			clientCerts = clientCerts[:1]
+		}
+	}
 	now := time.Now()
 	for _, cert := range clientCerts {
 		if now.Before(cert.NotBefore) {
@@ -27,33 +190,163 @@ func enforceCertificateValidity(clientCerts []*x509.Certificate, conn net.Conn,
 	}
 }
 
-func handleCertificateZones(URL *url.URL, clientCerts []*x509.Certificate, config UserConfig, conn net.Conn, logEntry *LogEntry) {
-	authorised := true
+// Refuse clientCerts if any of them is on the deny list.
+func enforceCertificateDenyList(clientCerts []*x509.Certificate, sysConfig SysConfig, config UserConfig, conn net.Conn, logEntry *LogEntry) {
+	denied := false
+	for _, cert := range clientCerts {
+		certDenied, _ := identifyCertificate(cert, config.DeniedCertificates, sysConfig)
+		if certDenied {
+			denied = true
+		}
+	}
+	for _, deniedSerial := range config.DeniedSerials {
+		issuer, serial, err := parseIssuerSerial(deniedSerial)
+		if err != nil {
+			continue
+		}
+		for _, cert := range clientCerts {
+			if cert.Issuer.String() == issuer && cert.SerialNumber.Cmp(serial) == 0 {
+				denied = true
+			}
+		}
+	}
+	if denied {
+		conn.Write([]byte("61 " + config.DeniedMessage + "\r\n"))
+		logEntry.Status = 61
+	}
+}
+
+// Split an entry of DeniedSerials, consisting of an issuer's
+// distinguished name and a hex-encoded serial number separated by a slash.
+func parseIssuerSerial(issuerSerial string) (string, *big.Int, error) {
+	slash := strings.LastIndex(issuerSerial, "/")
+	if slash == -1 {
+		return "", nil, errors.New("Missing serial number in denied serial " + issuerSerial)
+	}
+	serial, ok := new(big.Int).SetString(strings.ReplaceAll(issuerSerial[slash+1:], ":", ""), 16)
+	if !ok {
+		return "", nil, errors.New("Invalid serial number in denied serial " + issuerSerial)
+	}
+	return issuerSerial[:slash], serial, nil
+}
+
+// Refuse the request if URL is in any certificate zone which clientCerts
+// are not authorised for, so that a path in several zones must satisfy all
+// of them.  Otherwise, return the name of the identity they were authorised
+// as, if any.
+func handleCertificateZones(URL *url.URL, clientCerts []*x509.Certificate, sysConfig SysConfig, config UserConfig, conn net.Conn, logEntry *LogEntry) string {
+	remoteUser := ""
 	for zone, allowedFingerprints := range config.CertificateZones {
 		matched, err := regexp.Match(zone, []byte(URL.Path))
 		if !matched || err != nil {
 			continue
 		}
-		authorised = false
-		for _, clientCert := range clientCerts {
-			for _, allowedFingerprint := range allowedFingerprints {
-				if getCertFingerprint(clientCert) == allowedFingerprint {
-					authorised = true
-					break
-				}
+		if len(clientCerts) == 0 {
+			refuseCertificate(clientCerts, conn, logEntry)
+			return ""
+		}
+		authorised, name := identifyCertificate(clientCerts[0], allowedFingerprints, sysConfig)
+		if !authorised {
+			refuseCertificate(clientCerts, conn, logEntry)
+			return ""
+		}
+		if name != "" {
+			remoteUser = name
+		}
+	}
+	return remoteUser
+}
+
+func handleCAZones(URL *url.URL, clientCerts []*x509.Certificate, config SysConfig, conn net.Conn, logEntry *LogEntry) {
+	for zone, caZone := range config.CAZones {
+		matched, err := regexp.MatchString(zone, URL.Path)
+		if !matched || err != nil {
+			continue
+		}
+		if !caZone.authorises(clientCerts) {
+			refuseCertificate(clientCerts, conn, logEntry)
+			return
+		}
+	}
+}
+
+// Report whether the first of clientCerts was issued by one of the zone's
+// CAs, possibly via intermediate CAs among the rest of clientCerts, and has
+// a subject matching the zone's patterns.
+func (caZone CAZone) authorises(clientCerts []*x509.Certificate) bool {
+	if len(clientCerts) == 0 {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range clientCerts[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := clientCerts[0].Verify(x509.VerifyOptions{
+		Roots:         caZone.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return false
+	}
+	subject := clientCerts[0].Subject
+	if caZone.CommonName != "" {
+		matched, err := regexp.MatchString(caZone.CommonName, subject.CommonName)
+		if !matched || err != nil {
+			return false
+		}
+	}
+	if caZone.OrganizationalUnit != "" {
+		for _, unit := range subject.OrganizationalUnit {
+			matched, err := regexp.MatchString(caZone.OrganizationalUnit, unit)
+			if matched && err == nil {
+				return true
 			}
 		}
+		return false
 	}
-	if !authorised {
-		if len(clientCerts) > 0 {
-			conn.Write([]byte("61 Provided certificate not authorised for this resource\r\n"))
-			logEntry.Status = 61
-		} else {
-			conn.Write([]byte("60 A pre-authorised certificate is required to access this resource\r\n"))
-			logEntry.Status = 60
+	return true
+}
+
+func refuseCertificate(clientCerts []*x509.Certificate, conn net.Conn, logEntry *LogEntry) {
+	if len(clientCerts) > 0 {
+		conn.Write([]byte("61 Provided certificate not authorised for this resource\r\n"))
+		logEntry.Status = 61
+	} else {
+		conn.Write([]byte("60 A pre-authorised certificate is required to access this resource\r\n"))
+		logEntry.Status = 60
+	}
+}
+
+// Report whether cert has one of the allowed fingerprints.  Fingerprints
+// prefixed with "sha256:" are of a whole certificate, and those prefixed
+// with "spki:" of its public key.  Fingerprints without a prefix are of
+// whichever of these defaultType says.  Anybody can make a certificate
+// containing somebody else's public key, so cert must be one whose key the
+// peer has proved it holds, i.e. the first of the chain it sent.
+func certificateMatches(cert *x509.Certificate, allowedFingerprints []string, defaultType string) bool {
+	certFingerprint := getCertFingerprint(cert)
+	keyFingerprint := getPublicKeyFingerprint(cert)
+	for _, allowedFingerprint := range allowedFingerprints {
+		fingerprintType, fingerprint := parseFingerprint(allowedFingerprint, defaultType)
+		if fingerprintType == "spki" && fingerprint == keyFingerprint {
+			return true
+		} else if fingerprintType == "sha256" && fingerprint == certFingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// Split a fingerprint into its type and hex-encoded hash.
+func parseFingerprint(fingerprint string, defaultType string) (string, string) {
+	fingerprint = strings.ToLower(strings.TrimSpace(fingerprint))
+	for _, fingerprintType := range []string{"sha256", "spki"} {
+		if strings.HasPrefix(fingerprint, fingerprintType+":") {
+			return fingerprintType, fingerprint[len(fingerprintType)+1:]
 		}
-		return
 	}
+	return defaultType, fingerprint
 }
 
 func getCertFingerprint(cert *x509.Certificate) string {
@@ -61,3 +354,11 @@ func getCertFingerprint(cert *x509.Certificate) string {
 	fingerprint := hex.EncodeToString(hash[:])
 	return fingerprint
 }
+
+// Unlike the fingerprint of the whole certificate, this stays the same
+// when a certificate is re-issued using the same key.
+func getPublicKeyFingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	fingerprint := hex.EncodeToString(hash[:])
+	return fingerprint
+}
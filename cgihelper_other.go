@@ -0,0 +1,19 @@
+//go:build js || nacl || plan9 || windows
+// +build js nacl plan9 windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+type CGIHelper struct {
+}
+
+var cgiHelper *CGIHelper
+
+func (helper *CGIHelper) start(ctx context.Context, scriptPath string, env []string, stdin io.Reader, limits CGILimits) (io.ReadCloser, io.ReadCloser, func() error, error) {
+	return nil, nil, nil, errors.New("UserCGIAsOwner is not supported on this platform")
+}
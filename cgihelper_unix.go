@@ -0,0 +1,485 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd illumos linux netbsd openbsd solaris
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// When UserCGIAsOwner is set, CGI scripts beneath the home document bases
+// are run by a helper process which is started before privileges are
+// dropped and so remains root.  The server sends the helper one byte over
+// a unix socket for each script to be run, with four file descriptors
+// attached: one end of a new socket pair used for the rest of the
+// conversation, and the script's stdin, stdout and stderr.  The helper
+// checks the script and, if it is acceptable, runs it as its owner.
+type CGIHelper struct {
+	control *net.UnixConn
+}
+
+var cgiHelper *CGIHelper
+
+// The name the helper is started with, which tells it to be the helper.
+const cgiHelperName = "molly-brown-cgi-helper"
+
+// Sent to the helper over the control socket when it starts, so that nobody
+// but the server can choose which directories it runs scripts from.
+type cgiHelperConfig struct {
+	Chroot       string
+	HomeDocBases []string
+}
+
+// The only environment variables passed on to scripts run by the helper, as
+// with suexec, so that the server can't be used to pass variables such as
+// LD_PRELOAD to programs running as other users.
+var cgiHelperEnvVariables = map[string]bool{
+	"AUTH_TYPE":              true,
+	"CONTENT_LENGTH":         true,
+	"CONTENT_TYPE":           true,
+	"GATEWAY_INTERFACE":      true,
+	"PATH_INFO":              true,
+	"QUERY_STRING":           true,
+	"REMOTE_ADDR":            true,
+	"REMOTE_USER":            true,
+	"REQUEST_METHOD":         true,
+	"REQUEST_URI":            true,
+	"SCRIPT_FILENAME":        true,
+	"SCRIPT_NAME":            true,
+	"SCRIPT_PATH":            true,
+	"SERVER_NAME":            true,
+	"SERVER_PORT":            true,
+	"SERVER_PROTOCOL":        true,
+	"SERVER_SOFTWARE":        true,
+	"TITAN_TOKEN":            true,
+	"TLS_CIPHER":             true,
+	"TLS_CLIENT_HASH":        true,
+	"TLS_CLIENT_ISSUER":      true,
+	"TLS_CLIENT_ISSUER_CN":   true,
+	"TLS_CLIENT_PUBKEY_HASH": true,
+	"TLS_CLIENT_SUBJECT":     true,
+	"TLS_CLIENT_SUBJECT_CN":  true,
+}
+
+type cgiHelperRequest struct {
+	Path    string
+	Env     []string
+	Timeout time.Duration
+	Limits  CGILimits
+}
+
+type cgiHelperReply struct {
+	Error string
+}
+
+// Start the privileged CGI helper, if required by config.  This must be
+// called before chrooting and before dropping privileges.
+func startCGIHelper(config SysConfig, chroot string) error {
+	if !config.UserCGIAsOwner {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("UserCGIAsOwner requires molly brown to be started as root")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.New("Could not find molly brown executable to start CGI helper: " + err.Error())
+	}
+	local, remote, err := unixSocketPair()
+	if err != nil {
+		return errors.New("Could not create CGI helper socket: " + err.Error())
+	}
+	defer remote.Close()
+
+	cmd := exec.Command(executable)
+	cmd.Args = []string{cgiHelperName}
+	cmd.Env = []string{}
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{remote}
+	err = cmd.Start()
+	if err != nil {
+		local.Close()
+		return errors.New("Could not start CGI helper: " + err.Error())
+	}
+	go cmd.Wait()
+
+	control, err := net.FileConn(local)
+	local.Close()
+	if err == nil {
+		err = json.NewEncoder(control).Encode(cgiHelperConfig{chroot, getHomeDocBases(config)})
+	}
+	if err != nil {
+		return errors.New("Could not connect to CGI helper: " + err.Error())
+	}
+	cgiHelper = &CGIHelper{control.(*net.UnixConn)}
+	return nil
+}
+
+// Create a connected pair of unix stream sockets, neither of which will be
+// inherited by CGI processes.
+func unixSocketPair() (*os.File, *os.File, error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(fds[0]), "unix socket"), os.NewFile(uintptr(fds[1]), "unix socket"), nil
+}
+
+// Ask the helper to run the CGI script at scriptPath as its owner, subject to
+// limits.  The script and its children are killed when ctx is done.  The returned function waits for the
+// script to exit, and must be called after stdout and stderr have been read.
+func (helper *CGIHelper) start(ctx context.Context, scriptPath string, env []string, stdin io.Reader, limits CGILimits) (io.ReadCloser, io.ReadCloser, func() error, error) {
+	if helper == nil {
+		return nil, nil, nil, errors.New("CGI helper is not running, UserCGIAsOwner requires a restart")
+	}
+
+	local, remote, err := unixSocketPair()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer remote.Close()
+	conn, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Create pipes for the script's standard streams, keeping only the
+	// ends the script doesn't use once the helper has the other ends
+	var files [6]*os.File
+	for i := 0; i < 6 && err == nil; i += 2 {
+		files[i], files[i+1], err = os.Pipe()
+	}
+	stdinRead, stdinWrite := files[0], files[1]
+	stdoutRead, stdoutWrite := files[2], files[3]
+	stderrRead, stderrWrite := files[4], files[5]
+	cleanup := func() {
+		conn.Close()
+		for _, file := range files {
+			if file != nil {
+				file.Close()
+			}
+		}
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+	rights := syscall.UnixRights(int(remote.Fd()), int(stdinRead.Fd()), int(stdoutWrite.Fd()), int(stderrWrite.Fd()))
+	_, _, err = helper.control.WriteMsgUnix([]byte{0}, rights, nil)
+	stdinRead.Close()
+	stdoutWrite.Close()
+	stderrWrite.Close()
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, errors.New("Could not contact CGI helper: " + err.Error())
+	}
+
+	// Send the request and wait to hear if the script was started
+	deadline, _ := ctx.Deadline()
+	request := cgiHelperRequest{scriptPath, env, time.Until(deadline), limits}
+	decoder := json.NewDecoder(conn)
+	var reply cgiHelperReply
+	err = json.NewEncoder(conn).Encode(request)
+	if err == nil {
+		err = decoder.Decode(&reply)
+	}
+	if err == nil && reply.Error != "" {
+		err = errors.New(reply.Error)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+
+	if stdin != nil {
+		go func() {
+			io.Copy(stdinWrite, stdin)
+			stdinWrite.Close()
+		}()
+	} else {
+		stdinWrite.Close()
+	}
+
+	// Closing the connection tells the helper to kill the script
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	wait := func() error {
+		var reply cgiHelperReply
+		err := decoder.Decode(&reply)
+		close(done)
+		conn.Close()
+		if err != nil {
+			return err
+		} else if reply.Error != "" {
+			return errors.New(reply.Error)
+		}
+		return nil
+	}
+	return stdoutRead, stderrRead, wait, nil
+}
+
+// Run as the CGI helper process, if this is what we were started as.  This
+// must be called before anything else happens in main.
+func runCGIHelperIfRequested() {
+	if len(os.Args) == 0 || os.Args[0] != cgiHelperName {
+		return
+	}
+
+	// Anybody can start the helper, so it must never run with privileges
+	// its invoker doesn't have, as it would if the executable is setuid
+	if os.Getuid() != os.Geteuid() || os.Getgid() != os.Getegid() {
+		log.Fatal("Refusing to run CGI helper in a setuid or setgid process")
+	}
+	// The server decides when to stop, by closing the control socket
+	signal.Ignore(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	findExecutable()
+
+	control, err := net.FileConn(os.NewFile(3, "control socket"))
+	if err != nil {
+		log.Fatal("CGI helper could not open control socket: " + err.Error())
+	}
+	unixControl := control.(*net.UnixConn)
+	config, err := readCGIHelperConfig(unixControl)
+	if err != nil {
+		log.Fatal("CGI helper could not read its configuration: " + err.Error())
+	}
+	if config.Chroot != "" {
+		err := syscall.Chroot(config.Chroot)
+		if err != nil {
+			log.Fatal("CGI helper could not chroot to " + config.Chroot + ": " + err.Error())
+		}
+	}
+	os.Chdir("/")
+	homeDocBases := config.HomeDocBases
+
+	buffer := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4*4))
+	for {
+		n, oobn, _, _, err := unixControl.ReadMsgUnix(buffer, oob)
+		if n == 0 || err != nil {
+			os.Exit(0)
+		}
+		var fds []int
+		messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err == nil && len(messages) == 1 {
+			fds, _ = syscall.ParseUnixRights(&messages[0])
+		}
+		if len(fds) != 4 {
+			for _, fd := range fds {
+				syscall.Close(fd)
+			}
+			continue
+		}
+		var files [4]*os.File
+		for i, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files[i] = os.NewFile(uintptr(fd), "cgi")
+		}
+		go serveCGIHelperRequest(homeDocBases, files[0], files[1], files[2], files[3])
+	}
+}
+
+// Read the helper's configuration, which is a line of JSON, a byte at a time
+// so as not to read past it into the first request.
+func readCGIHelperConfig(control *net.UnixConn) (cgiHelperConfig, error) {
+	var config cgiHelperConfig
+	var line []byte
+	buffer := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\n")) {
+		_, err := control.Read(buffer)
+		if err != nil {
+			return config, err
+		}
+		line = append(line, buffer[0])
+		if len(line) > 65536 {
+			return config, errors.New("Configuration too long")
+		}
+	}
+	err := json.Unmarshal(line, &config)
+	return config, err
+}
+
+// Keep only the variables in env which are safe to pass to a script run as
+// another user.
+func filterCGIHelperEnv(env []string) []string {
+	filtered := []string{}
+	for _, variable := range env {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if cgiHelperEnvVariables[name] {
+			filtered = append(filtered, variable)
+		}
+	}
+	return filtered
+}
+
+func serveCGIHelperRequest(homeDocBases []string, connFile, stdin, stdout, stderr *os.File) {
+	conn, err := net.FileConn(connFile)
+	connFile.Close()
+	if err != nil {
+		stdin.Close()
+		stdout.Close()
+		stderr.Close()
+		return
+	}
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+
+	var request cgiHelperRequest
+	err = decoder.Decode(&request)
+	var credential *syscall.Credential
+	var scriptPath string
+	if err == nil {
+		credential, scriptPath, err = checkCGIScriptOwner(request.Path, homeDocBases)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), request.Timeout)
+	defer cancel()
+	if err == nil {
+		cmd := exec.Command(scriptPath)
+		cmd.Env = filterCGIHelperEnv(request.Env)
+		cmd.Stdin = stdin
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		var started func()
+		started, err = limitCGICommand(cmd, request.Limits)
+		if err == nil {
+			cmd.SysProcAttr.Credential = credential
+			err = cmd.Start()
+			started()
+		}
+		stdin.Close()
+		stdout.Close()
+		stderr.Close()
+		if err == nil {
+			wait := watchCGIProcess(ctx, cmd)
+			encoder.Encode(cgiHelperReply{})
+			go func() {
+				// Any data or EOF means the server has given up
+				conn.Read(make([]byte, 1))
+				cancel()
+			}()
+			err = wait()
+			var reply cgiHelperReply
+			if err != nil {
+				reply.Error = err.Error()
+			}
+			encoder.Encode(reply)
+			return
+		}
+	} else {
+		stdin.Close()
+		stdout.Close()
+		stderr.Close()
+	}
+	encoder.Encode(cgiHelperReply{err.Error()})
+}
+
+// Check that the CGI script at scriptPath may be run as its owner, in the
+// style of Apache's suexec.  The script must lie within some user's
+// directory beneath one of homeDocBases and be owned by that user, who may
+// not be root.  Neither the script nor any directory between it and the
+// user's directory may be writable by anybody but the user.  The credential
+// to run the script with and the script's real path are returned.
+func checkCGIScriptOwner(scriptPath string, homeDocBases []string) (*syscall.Credential, string, error) {
+	realPath, err := filepath.EvalSymlinks(scriptPath)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, homeDocBase := range homeDocBases {
+		realHomeDocBase, err := filepath.EvalSymlinks(homeDocBase)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(realHomeDocBase, realPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			continue
+		}
+		components := strings.Split(rel, string(os.PathSeparator))
+		if len(components) < 2 {
+			continue
+		}
+
+		// Find the user whose directory the script is in
+		owner, err := user.Lookup(components[0])
+		if err != nil {
+			return nil, "", errors.New("Refusing to run " + scriptPath + " not in a user's directory")
+		}
+		uid, err := strconv.Atoi(owner.Uid)
+		if err != nil {
+			return nil, "", err
+		}
+		gid, err := strconv.Atoi(owner.Gid)
+		if err != nil {
+			return nil, "", err
+		}
+		if uid == 0 || gid == 0 {
+			return nil, "", errors.New("Refusing to run " + scriptPath + " as root")
+		}
+
+		// Check ownership and permissions all the way down
+		path := realHomeDocBase
+		for i, component := range components {
+			path = filepath.Join(path, component)
+			info, err := os.Lstat(path)
+			if err != nil {
+				return nil, "", err
+			}
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok || int(stat.Uid) != uid {
+				return nil, "", errors.New("Refusing to run " + scriptPath + " because " + path + " is not owned by " + owner.Username)
+			}
+			if info.Mode().Perm()&0022 != 0 {
+				return nil, "", errors.New("Refusing to run " + scriptPath + " because " + path + " is writable by others")
+			}
+			if i == len(components)-1 {
+				if !info.Mode().IsRegular() || info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 || info.Mode().Perm()&0100 == 0 {
+					return nil, "", errors.New("Refusing to run " + scriptPath + " because it is not a plain executable file")
+				}
+			} else if !info.IsDir() {
+				return nil, "", errors.New("Refusing to run " + scriptPath + " because " + path + " is not a directory")
+			}
+		}
+
+		credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+		groupIds, err := owner.GroupIds()
+		if err == nil {
+			for _, groupId := range groupIds {
+				group, err := strconv.Atoi(groupId)
+				if err == nil && group != 0 {
+					credential.Groups = append(credential.Groups, uint32(group))
+				}
+			}
+		}
+		return credential, realPath, nil
+	}
+	return nil, "", errors.New("Refusing to run " + scriptPath + " not beneath a HomeDocBase")
+}
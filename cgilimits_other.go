@@ -0,0 +1,20 @@
+//go:build js || nacl || plan9 || windows
+// +build js nacl plan9 windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func limitCGICommand(cmd *exec.Cmd, limits CGILimits) (func(), error) {
+	if limits != (CGILimits{}) {
+		return nil, errors.New("CGI resource limits are not supported on this platform")
+	}
+	return func() {}, nil
+}
+
+func killCGIProcess(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
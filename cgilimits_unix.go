@@ -0,0 +1,121 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd illumos linux netbsd openbsd solaris
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The path of the molly brown executable, found at startup before any
+// chroot.  Resource limits are applied to CGI processes by running this
+// executable as a wrapper, which sets the limits and then execs the script.
+var executablePath string
+
+// The name the wrapper is started with, which tells it to be the wrapper.
+const cgiLimitsWrapperName = "molly-brown-cgi-limits"
+
+func findExecutable() {
+	executablePath, _ = os.Executable()
+}
+
+// Arrange for cmd to run in a process group of its own, so that it can be
+// killed together with any children, and for limits to be applied to it.
+// The returned function must be called once cmd has been started, or has
+// failed to start.
+func limitCGICommand(cmd *exec.Cmd, limits CGILimits) (func(), error) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if limits == (CGILimits{}) {
+		return func() {}, nil
+	}
+	if executablePath == "" {
+		return nil, errors.New("Could not find molly brown executable to apply CGI resource limits")
+	}
+	values := []string{
+		strconv.FormatInt(limits.CPUTime, 10),
+		strconv.FormatInt(limits.Memory, 10),
+		strconv.FormatInt(limits.OpenFiles, 10),
+		strconv.FormatInt(limits.Processes, 10),
+	}
+
+	// Pass the limits to the wrapper over a pipe on its fd 3.  The limits
+	// are small enough to fit in the pipe's buffer, so this can't block.
+	limitsRead, limitsWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	_, err = limitsWrite.WriteString(strings.Join(values, ":"))
+	limitsWrite.Close()
+	if err != nil {
+		limitsRead.Close()
+		return nil, err
+	}
+	cmd.Args = append([]string{cgiLimitsWrapperName}, cmd.Args...)
+	cmd.Path = executablePath
+	cmd.ExtraFiles = []*os.File{limitsRead}
+	return func() { limitsRead.Close() }, nil
+}
+
+// Kill the process started by cmd and everything else in its process group.
+func killCGIProcess(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// Act as the resource limiting wrapper for a CGI process, if this is what we
+// were started as.  This must be called before anything else happens in
+// main.
+func runCGIWrapperIfRequested() {
+	if len(os.Args) == 0 || os.Args[0] != cgiLimitsWrapperName {
+		return
+	}
+
+	// Anybody can start the wrapper, so it must never run with privileges
+	// its invoker doesn't have, as it would if the executable is setuid
+	if os.Getuid() != os.Geteuid() || os.Getgid() != os.Getegid() {
+		os.Stderr.WriteString("Refusing to apply CGI resource limits in a setuid or setgid process\n")
+		os.Exit(1)
+	}
+	limitsFile := os.NewFile(3, "cgi limits")
+	data, err := ioutil.ReadAll(io.LimitReader(limitsFile, 256))
+	limitsFile.Close()
+	values := strings.Split(string(data), ":")
+	if err != nil || len(values) != 4 || len(os.Args) < 2 {
+		os.Stderr.WriteString("Invalid CGI resource limits\n")
+		os.Exit(1)
+	}
+	resources := []int{unix.RLIMIT_CPU, rlimitMemory, unix.RLIMIT_NOFILE, rlimitProcesses}
+	for i, value := range values {
+		if value == "0" {
+			continue
+		}
+		if resources[i] < 0 {
+			os.Stderr.WriteString("CGIMaxProcesses is not supported on this platform\n")
+			os.Exit(1)
+		}
+		// The type of Rlimit's fields differs between platforms
+		var rlimit unix.Rlimit
+		_, err := fmt.Sscan(value, &rlimit.Cur)
+		if err != nil {
+			os.Stderr.WriteString("Invalid CGI resource limit " + value + "\n")
+			os.Exit(1)
+		}
+		rlimit.Max = rlimit.Cur
+		err = unix.Setrlimit(resources[i], &rlimit)
+		if err != nil {
+			os.Stderr.WriteString("Could not set CGI resource limit: " + err.Error() + "\n")
+			os.Exit(1)
+		}
+	}
+	err = syscall.Exec(os.Args[1], os.Args[1:], os.Environ())
+	os.Stderr.WriteString("Could not execute " + os.Args[1] + ": " + err.Error() + "\n")
+	os.Exit(1)
+}
@@ -1,31 +1,105 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"io/ioutil"
 	"github.com/BurntSushi/toml"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
 type SysConfig struct {
 	Port                  int
+	Listen                []string
+	ListenFD              int
+	ProxyProtocolSources  []string
+	ShutdownTimeout       int
+	AllowUpgrade          bool
 	Hostname              string
 	CertPath              string
 	KeyPath               string
+	AutoCertificate       bool
+	AutoCertificateType   string
+	AutoCertificateDays   int
+	AutoRenewDays         int
+	ExpiryWarningDays     []int
 	AccessLog             string
 	ErrorLog              string
 	DocBase               string
 	HomeDocBase           string
 	CGIPaths              []string
+	CGITimeout            int
+	CGIPathTimeouts       map[string]int
+	UserCGIAsOwner        bool
+	CGIMaxConcurrent      int
+	CGIMaxCPUTime         int64
+	CGIMaxMemory          int64
+	CGIMaxOpenFiles       int64
+	CGIMaxProcesses       int64
+	CGIMaxOutput          int64
 	SCGIPaths             map[string]string
+	FastCGIPaths          map[string]string
+	GatewayConnectTimeout int
+	GatewayReadTimeout    int
+	ProxyPaths            map[string]string
+	ProxyPins             map[string][]string
+	ProxyCertPath         string
+	ProxyKeyPath          string
+	ProxyIdentitySecret   string
+	ProxyCertificate      *tls.Certificate `toml:"-"`
 	ReadMollyFiles        bool
 	AllowTLS12            bool
+	RequireLandlock       bool
+	SeccompMode           string
+	SeccompAllow          []int
 	RateLimitEnable       bool
 	RateLimitAverage      int
 	RateLimitSoft         int
 	RateLimitHard         int
+	TitanZones            map[string][]string
+	TitanMaxSize          int64
+	CAZones               map[string]CAZone
+	FingerprintType       string
+	Identities            map[string]string
+	Groups                map[string][]string
+	GroupFiles            map[string]string
+	RegistrationZones     map[string]string
+	PasswordZones         map[string]PasswordZone
+	PasswordSessionTime   int
+	IdentityGroups        map[string]*identityGroup `toml:"-"`
+	VirtualHosts          []VirtualHost `toml:"-"`
+	ConfigFile            string `toml:"-"`
+	WorkingDir            string `toml:"-"`
+}
+
+type CAZone struct {
+	CAFile                string
+	CommonName            string
+	OrganizationalUnit    string
+	Roots                 *x509.CertPool `toml:"-"`
+}
+
+type PasswordZone struct {
+	PasswordFile          string
+	Prompt                string
+}
+
+type VirtualHost struct {
+	Hostnames             []string
+	CertPath              string
+	KeyPath               string
+	DocBase               string
+	HomeDocBase           string
+	CGIPaths              []string
+	SCGIPaths             map[string]string
+	FastCGIPaths          map[string]string
+	ProxyPaths            map[string]string
+	UserConfig            UserConfig `toml:"-"`
 }
 
 type UserConfig struct {
@@ -36,6 +110,11 @@ type UserConfig struct {
 	PermRedirects         map[string]string
 	MimeOverrides         map[string]string
 	CertificateZones      map[string][]string
+	CertificateValidity   string
+	CertificateValidityZones map[string]string
+	DeniedCertificates    []string
+	DeniedSerials         []string
+	DeniedMessage         string
 	DirectoryListing      bool
 	DirectorySort         string
 	DirectorySubdirsFirst bool
@@ -44,33 +123,89 @@ type UserConfig struct {
 }
 
 func getConfig(filename string) (SysConfig, UserConfig, error) {
+	workingDir, err := os.Getwd()
+	if err != nil {
+		var sysConfig SysConfig
+		var userConfig UserConfig
+		return sysConfig, userConfig, err
+	}
+	return readConfig(filename, workingDir)
+}
+
+// Relative paths in the config file are resolved relative to workingDir,
+// which should be the directory Molly Brown was started in even when the
+// config is being reloaded after a chdir.
+func readConfig(filename string, workingDir string) (SysConfig, UserConfig, error) {
 
 	var sysConfig SysConfig
 	var userConfig UserConfig
 
 	// Defaults
 	sysConfig.Port = 1965
+	sysConfig.Listen = make([]string, 0)
+	sysConfig.ListenFD = 0
+	sysConfig.ProxyProtocolSources = make([]string, 0)
+	sysConfig.ShutdownTimeout = 30
+	sysConfig.AllowUpgrade = false
 	sysConfig.Hostname = "localhost"
 	sysConfig.CertPath = "cert.pem"
 	sysConfig.KeyPath = "key.pem"
+	sysConfig.AutoCertificate = false
+	sysConfig.AutoCertificateType = "ecdsa"
+	sysConfig.AutoCertificateDays = 3650
+	sysConfig.AutoRenewDays = 30
+	sysConfig.ExpiryWarningDays = []int{30, 7, 1}
 	sysConfig.AccessLog = "access.log"
 	sysConfig.ErrorLog = ""
 	sysConfig.DocBase = "/var/gemini/"
 	sysConfig.HomeDocBase = "users"
 	sysConfig.CGIPaths = make([]string, 0)
+	sysConfig.CGITimeout = 10
+	sysConfig.CGIPathTimeouts = make(map[string]int)
+	sysConfig.UserCGIAsOwner = false
+	sysConfig.CGIMaxConcurrent = 0
+	sysConfig.CGIMaxCPUTime = 0
+	sysConfig.CGIMaxMemory = 0
+	sysConfig.CGIMaxOpenFiles = 0
+	sysConfig.CGIMaxProcesses = 0
+	sysConfig.CGIMaxOutput = 0
 	sysConfig.SCGIPaths = make(map[string]string)
+	sysConfig.FastCGIPaths = make(map[string]string)
+	sysConfig.GatewayConnectTimeout = 5
+	sysConfig.GatewayReadTimeout = 30
+	sysConfig.ProxyPaths = make(map[string]string)
+	sysConfig.ProxyPins = make(map[string][]string)
 	sysConfig.ReadMollyFiles = false
 	sysConfig.AllowTLS12 = true
+	sysConfig.RequireLandlock = false
+	sysConfig.SeccompMode = "off"
+	sysConfig.SeccompAllow = make([]int, 0)
 	sysConfig.RateLimitEnable = false
 	sysConfig.RateLimitAverage = 1
 	sysConfig.RateLimitSoft = 10
 	sysConfig.RateLimitHard = 50
+	sysConfig.TitanZones = make(map[string][]string)
+	sysConfig.TitanMaxSize = 1048576
+	sysConfig.CAZones = make(map[string]CAZone)
+	sysConfig.FingerprintType = "sha256"
+	sysConfig.Identities = make(map[string]string)
+	sysConfig.Groups = make(map[string][]string)
+	sysConfig.GroupFiles = make(map[string]string)
+	sysConfig.RegistrationZones = make(map[string]string)
+	sysConfig.PasswordZones = make(map[string]PasswordZone)
+	sysConfig.PasswordSessionTime = 86400
+	sysConfig.WorkingDir = workingDir
 
 	userConfig.GeminiExt = "gmi"
 	userConfig.DefaultLang = ""
 	userConfig.DefaultEncoding = ""
 	userConfig.TempRedirects = make(map[string]string)
 	userConfig.PermRedirects = make(map[string]string)
+	userConfig.CertificateValidity = "chain"
+	userConfig.CertificateValidityZones = make(map[string]string)
+	userConfig.DeniedCertificates = make([]string, 0)
+	userConfig.DeniedSerials = make([]string, 0)
+	userConfig.DeniedMessage = "Provided certificate has been revoked"
 	userConfig.DirectoryListing = true
 	userConfig.DirectorySort = "Name"
 	userConfig.DirectorySubdirsFirst = false
@@ -80,6 +215,11 @@ func getConfig(filename string) (SysConfig, UserConfig, error) {
 		return sysConfig, userConfig, nil
 	}
 
+	// Remember where the config came from, so it can be reloaded even
+	// after we chdir away
+	filename = absolutise(filename, workingDir)
+	sysConfig.ConfigFile = filename
+
 	// Attempt to overwrite defaults from file
 	sysConfig, err := readSysConfig(filename, sysConfig)
 	if err != nil {
@@ -89,6 +229,10 @@ func getConfig(filename string) (SysConfig, UserConfig, error) {
 	if err != nil {
 		return sysConfig, userConfig, err
 	}
+	sysConfig.VirtualHosts, err = readVirtualHosts(filename, sysConfig, userConfig)
+	if err != nil {
+		return sysConfig, userConfig, err
+	}
 	return sysConfig, userConfig, nil
 }
 
@@ -102,59 +246,290 @@ func readSysConfig(filename string, config SysConfig) (SysConfig, error) {
 	// Force hostname to lowercase
 	config.Hostname = strings.ToLower(config.Hostname)
 
+	// Validate pseudo-enums
+	if config.FingerprintType != "sha256" && config.FingerprintType != "spki" {
+		return config, errors.New("Invalid FingerprintType value.")
+	}
+
 	// Absolutise paths
-	config.DocBase, err = filepath.Abs(config.DocBase)
+	config.DocBase = absolutise(config.DocBase, config.WorkingDir)
+	config.CertPath = absolutise(config.CertPath, config.WorkingDir)
+	config.KeyPath = absolutise(config.KeyPath, config.WorkingDir)
+	if config.AccessLog != "" && config.AccessLog != "-" {
+		config.AccessLog = absolutise(config.AccessLog, config.WorkingDir)
+	}
+	if config.ErrorLog != "" {
+		config.ErrorLog = absolutise(config.ErrorLog, config.WorkingDir)
+	}
+	if config.ProxyCertPath != "" {
+		config.ProxyCertPath = absolutise(config.ProxyCertPath, config.WorkingDir)
+		config.ProxyKeyPath = absolutise(config.ProxyKeyPath, config.WorkingDir)
+	}
+
+	// Absolutise and expand CGI paths
+	config.CGIPaths, err = expandCGIPaths(config.CGIPaths, config.DocBase)
 	if err != nil {
 		return config, err
 	}
-	config.CertPath, err = filepath.Abs(config.CertPath)
+
+	// Absolutise CGI timeout paths
+	cgiPathTimeouts := make(map[string]int)
+	for cgiPath, timeout := range config.CGIPathTimeouts {
+		if !filepath.IsAbs(cgiPath) {
+			cgiPath = filepath.Join(config.DocBase, cgiPath)
+		}
+		cgiPathTimeouts[cgiPath] = timeout
+	}
+	config.CGIPathTimeouts = cgiPathTimeouts
+
+	// Absolutise SCGI paths
+	absolutiseGatewayPaths(config.SCGIPaths, config.WorkingDir)
+	absolutiseGatewayPaths(config.FastCGIPaths, config.WorkingDir)
+
+	// Load CA bundles for CA zones
+	err = loadCAZones(config.CAZones, config.WorkingDir)
 	if err != nil {
 		return config, err
 	}
-	config.KeyPath, err = filepath.Abs(config.KeyPath)
+
+	// Absolutise group file paths and load identity groups
+	for name, path := range config.GroupFiles {
+		config.GroupFiles[name] = absolutise(path, config.WorkingDir)
+	}
+	config.IdentityGroups, err = loadIdentityGroups(config)
 	if err != nil {
 		return config, err
 	}
-	if config.AccessLog != "" && config.AccessLog != "-" {
-		config.AccessLog, err = filepath.Abs(config.AccessLog)
+	for zone, groupName := range config.RegistrationZones {
+		_, present := config.GroupFiles[groupName]
+		if !present {
+			return config, errors.New("Registration zone " + zone + " uses group " + groupName + " which is not in GroupFiles")
+		}
+	}
+
+	// Absolutise and check password files for password zones
+	for zone, passwordZone := range config.PasswordZones {
+		if passwordZone.PasswordFile == "" {
+			return config, errors.New("No PasswordFile given for password zone " + zone)
+		}
+		passwordZone.PasswordFile = absolutise(passwordZone.PasswordFile, config.WorkingDir)
+		_, err = readPasswordFile(passwordZone.PasswordFile)
 		if err != nil {
-			return config, err
+			return config, errors.New("Error reading password file for password zone " + zone + ": " + err.Error())
 		}
+		if passwordZone.Prompt == "" {
+			passwordZone.Prompt = "Password"
+		} else if strings.ContainsAny(passwordZone.Prompt, "\r\n") {
+			return config, errors.New("Invalid Prompt containing line break for password zone " + zone)
+		}
+		config.PasswordZones[zone] = passwordZone
 	}
-	if config.ErrorLog != "" {
-		config.ErrorLog, err = filepath.Abs(config.ErrorLog)
+
+	return config, nil
+}
+
+func loadCAZones(caZones map[string]CAZone, workingDir string) error {
+	for zone, caZone := range caZones {
+		if caZone.CAFile == "" {
+			return errors.New("No CAFile given for CA zone " + zone)
+		}
+		caZone.CAFile = absolutise(caZone.CAFile, workingDir)
+		caBytes, err := ioutil.ReadFile(caZone.CAFile)
 		if err != nil {
-			return config, err
+			return errors.New("Error reading CA file for CA zone " + zone + ": " + err.Error())
+		}
+		caZone.Roots = x509.NewCertPool()
+		if !caZone.Roots.AppendCertsFromPEM(caBytes) {
+			return errors.New("No certificates found in CA file " + caZone.CAFile)
 		}
+		for _, pattern := range []string{zone, caZone.CommonName, caZone.OrganizationalUnit} {
+			_, err = regexp.Compile(pattern)
+			if err != nil {
+				return errors.New("Invalid regexp in CA zone " + zone + ": " + err.Error())
+			}
+		}
+		caZones[zone] = caZone
 	}
+	return nil
+}
 
+func expandCGIPaths(cgiPaths []string, docBase string) ([]string, error) {
 	// Absolutise CGI paths
-	for index, cgiPath := range config.CGIPaths {
+	for index, cgiPath := range cgiPaths {
 		if !filepath.IsAbs(cgiPath) {
-			config.CGIPaths[index] = filepath.Join(config.DocBase, cgiPath)
+			cgiPaths[index] = filepath.Join(docBase, cgiPath)
 		}
 	}
 
 	// Expand CGI paths
-	var cgiPaths []string
-	for _, cgiPath := range config.CGIPaths {
+	var expanded []string
+	for _, cgiPath := range cgiPaths {
 		expandedPaths, err := filepath.Glob(cgiPath)
 		if err != nil {
-			return config, errors.New("Error expanding CGI path glob " + cgiPath + ": " + err.Error())
+			return expanded, errors.New("Error expanding CGI path glob " + cgiPath + ": " + err.Error())
 		}
-		cgiPaths = append(cgiPaths, expandedPaths...)
+		expanded = append(expanded, expandedPaths...)
 	}
-	config.CGIPaths = cgiPaths
+	return expanded, nil
+}
 
-	// Absolutise SCGI paths
-	for index, scgiPath := range config.SCGIPaths {
-		config.SCGIPaths[index], err = filepath.Abs( scgiPath)
+// The directories beneath which each user's CGI scripts are run as that
+// user, one for the main host and each virtual host.
+func getHomeDocBases(config SysConfig) []string {
+	homeDocBases := []string{filepath.Join(config.DocBase, config.HomeDocBase)}
+	for _, vhost := range config.VirtualHosts {
+		homeDocBases = append(homeDocBases, filepath.Join(vhost.DocBase, vhost.HomeDocBase))
+	}
+	return homeDocBases
+}
+
+// The files which are re-read on SIGHUP or while running, and so must remain
+// readable after any security restrictions are applied.
+func getReloadPaths(config SysConfig) []string {
+	reloadPaths := []string{config.CertPath, config.KeyPath}
+	if config.ConfigFile != "" {
+		reloadPaths = append(reloadPaths, config.ConfigFile)
+	}
+	if config.ProxyCertPath != "" {
+		reloadPaths = append(reloadPaths, config.ProxyCertPath, config.ProxyKeyPath)
+	}
+	for _, vhost := range config.VirtualHosts {
+		reloadPaths = append(reloadPaths, vhost.CertPath, vhost.KeyPath)
+	}
+	for _, caZone := range config.CAZones {
+		reloadPaths = append(reloadPaths, caZone.CAFile)
+	}
+	for _, groupFile := range config.GroupFiles {
+		reloadPaths = append(reloadPaths, groupFile)
+	}
+	for _, passwordZone := range config.PasswordZones {
+		reloadPaths = append(reloadPaths, passwordZone.PasswordFile)
+	}
+	return reloadPaths
+}
+
+// Report whether unix domain sockets are used, by gateway applications or to
+// listen on, and whether gateway applications or proxied Gemini servers are
+// reached over TCP.
+func getSocketUses(config SysConfig) (bool, bool) {
+	gatewayPaths := []map[string]string{config.SCGIPaths, config.FastCGIPaths}
+	tcp := len(config.ProxyPaths) > 0
+	for _, vhost := range config.VirtualHosts {
+		tcp = tcp || len(vhost.ProxyPaths) > 0
+		gatewayPaths = append(gatewayPaths, vhost.SCGIPaths, vhost.FastCGIPaths)
+	}
+	unixSockets := false
+	for _, paths := range gatewayPaths {
+		for _, address := range paths {
+			if strings.HasPrefix(address, "tcp://") {
+				tcp = true
+			} else {
+				unixSockets = true
+			}
+		}
+	}
+	for _, address := range config.Listen {
+		unixSockets = unixSockets || strings.HasPrefix(address, "unix:")
+	}
+	return unixSockets, tcp
+}
+
+// The group files which clients can register themselves in, and so must
+// remain writable after any security restrictions are applied.
+func getRegistrationFiles(config SysConfig) []string {
+	var registrationFiles []string
+	for _, groupName := range config.RegistrationZones {
+		registrationFiles = append(registrationFiles, config.GroupFiles[groupName])
+	}
+	return registrationFiles
+}
+
+// Absolutise the paths of unix domain sockets used by gateway applications,
+// leaving tcp:// addresses untouched.
+func absolutiseGatewayPaths(scgiPaths map[string]string, workingDir string) {
+	for index, scgiPath := range scgiPaths {
+		if !strings.HasPrefix(scgiPath, "tcp://") {
+			scgiPaths[index] = absolutise(scgiPath, workingDir)
+		}
+	}
+}
+
+func absolutise(path string, workingDir string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(workingDir, path)
+}
+
+func readVirtualHosts(filename string, sysConfig SysConfig, userConfig UserConfig) ([]VirtualHost, error) {
+
+	var vhosts []VirtualHost
+	var raw struct {
+		VirtualHost []toml.Primitive
+	}
+	md, err := toml.DecodeFile(filename, &raw)
+	if err != nil {
+		return vhosts, err
+	}
+
+	for _, prim := range raw.VirtualHost {
+		// Settings not given for a virtual host are inherited from the
+		// main config, except for dynamic content paths which are
+		// relative to the virtual host's own DocBase
+		var vhost VirtualHost
+		vhost.CertPath = sysConfig.CertPath
+		vhost.KeyPath = sysConfig.KeyPath
+		vhost.DocBase = sysConfig.DocBase
+		vhost.HomeDocBase = sysConfig.HomeDocBase
+		vhost.SCGIPaths = make(map[string]string)
+		vhost.FastCGIPaths = make(map[string]string)
+		vhost.ProxyPaths = make(map[string]string)
+		err = md.PrimitiveDecode(prim, &vhost)
+		if err != nil {
+			return vhosts, err
+		}
+		if len(vhost.Hostnames) == 0 {
+			return vhosts, errors.New("Virtual host defined without any Hostnames")
+		}
+		for index, hostname := range vhost.Hostnames {
+			vhost.Hostnames[index] = strings.ToLower(hostname)
+		}
+
+		// Absolutise paths
+		vhost.DocBase = absolutise(vhost.DocBase, sysConfig.WorkingDir)
+		vhost.CertPath = absolutise(vhost.CertPath, sysConfig.WorkingDir)
+		vhost.KeyPath = absolutise(vhost.KeyPath, sysConfig.WorkingDir)
+		vhost.CGIPaths, err = expandCGIPaths(vhost.CGIPaths, vhost.DocBase)
+		if err != nil {
+			return vhosts, err
+		}
+		absolutiseGatewayPaths(vhost.SCGIPaths, sysConfig.WorkingDir)
+		absolutiseGatewayPaths(vhost.FastCGIPaths, sysConfig.WorkingDir)
+
+		// Decode user settings on top of a copy of the main ones.
+		// Replace map variables so the main config isn't modified.
+		vhost.UserConfig = userConfig
+		vhost.UserConfig.TempRedirects = make(map[string]string)
+		vhost.UserConfig.PermRedirects = make(map[string]string)
+		vhost.UserConfig.MimeOverrides = make(map[string]string)
+		vhost.UserConfig.CertificateZones = make(map[string][]string)
+		vhost.UserConfig.CertificateValidityZones = make(map[string]string)
+		vhost.UserConfig.DeniedCertificates = nil
+		vhost.UserConfig.DeniedSerials = nil
+		err = md.PrimitiveDecode(prim, &vhost.UserConfig)
+		if err != nil {
+			return vhosts, err
+		}
+		addDenyLists(&vhost.UserConfig, userConfig)
+		err = validateUserConfig(filename, &vhost.UserConfig, true)
 		if err != nil {
-			return config, err
+			return vhosts, err
 		}
+
+		vhosts = append(vhosts, vhost)
 	}
 
-	return config, nil
+	return vhosts, nil
 }
 
 func readUserConfig(filename string, config UserConfig, requireValid bool) (UserConfig, error) {
@@ -163,13 +538,60 @@ func readUserConfig(filename string, config UserConfig, requireValid bool) (User
 	if err != nil {
 		return config, err
 	}
+	err = validateUserConfig(filename, &config, requireValid)
+	return config, err
+}
+
+func validateUserConfig(filename string, config *UserConfig, requireValid bool) error {
 
 	// Validate pseudo-enums
 	if requireValid {
 		switch config.DirectorySort {
 			case "Name", "Size", "Time":
 			default:
-				return config, errors.New("Invalid DirectorySort value.")
+				return errors.New("Invalid DirectorySort value.")
+		}
+	}
+
+	// Validate client certificate validity policies
+	if !validCertificateValidity(config.CertificateValidity) {
+		if requireValid {
+			return errors.New("Invalid CertificateValidity value.")
+		} else {
+			log.Println("Ignoring invalid CertificateValidity value " + config.CertificateValidity + " in .molly file " + filename)
+			config.CertificateValidity = "chain"
+		}
+	}
+	for zone, policy := range config.CertificateValidityZones {
+		if !validCertificateValidity(policy) {
+			if requireValid {
+				return errors.New("Invalid CertificateValidityZones value " + policy)
+			} else {
+				log.Println("Ignoring invalid CertificateValidityZones value " + policy + " in .molly file " + filename)
+				delete(config.CertificateValidityZones, zone)
+			}
+		}
+	}
+
+	// Validate deny list
+	if strings.ContainsAny(config.DeniedMessage, "\r\n") {
+		if requireValid {
+			return errors.New("Invalid DeniedMessage containing line break.")
+		} else {
+			log.Println("Ignoring DeniedMessage containing line break in .molly file " + filename)
+			config.DeniedMessage = "Provided certificate has been revoked"
+		}
+	}
+	for _, deniedSerial := range config.DeniedSerials {
+		_, _, err := parseIssuerSerial(deniedSerial)
+		if err != nil {
+			if requireValid {
+				return err
+			} else {
+				log.Println("Ignoring DeniedSerials in .molly file " + filename + ": " + err.Error())
+				config.DeniedSerials = nil
+				break
+			}
 		}
 	}
 
@@ -177,7 +599,7 @@ func readUserConfig(filename string, config UserConfig, requireValid bool) (User
 	for key, value := range config.TempRedirects {
 		if strings.Contains(value, "://") && !strings.HasPrefix(value, "gemini://") {
 			if requireValid {
-				return config, errors.New("Invalid cross-protocol redirect to " + value)
+				return errors.New("Invalid cross-protocol redirect to " + value)
 			} else {
 				log.Println("Ignoring cross-protocol redirect to " + value + " in .molly file " + filename)
 				delete(config.TempRedirects, key)
@@ -187,7 +609,7 @@ func readUserConfig(filename string, config UserConfig, requireValid bool) (User
 	for key, value := range config.PermRedirects {
 		if strings.Contains(value, "://") && !strings.HasPrefix(value, "gemini://") {
 			if requireValid {
-				return config, errors.New("Invalid cross-protocol redirect to " + value)
+				return errors.New("Invalid cross-protocol redirect to " + value)
 			} else {
 				log.Println("Ignoring cross-protocol redirect to " + value + " in .molly file " + filename)
 				delete(config.PermRedirects, key)
@@ -195,7 +617,15 @@ func readUserConfig(filename string, config UserConfig, requireValid bool) (User
 		}
 	}
 
-	return config, nil
+	return nil
+}
+
+// Add the deny lists of parent to those of config, so that lists set in
+// .molly files or for virtual hosts add to those inherited from above
+// instead of replacing them.
+func addDenyLists(config *UserConfig, parent UserConfig) {
+	config.DeniedCertificates = append(append([]string{}, parent.DeniedCertificates...), config.DeniedCertificates...)
+	config.DeniedSerials = append(append([]string{}, parent.DeniedSerials...), config.DeniedSerials...)
 }
 
 func parseMollyFiles(path string, docBase string, config UserConfig) UserConfig {
@@ -205,6 +635,7 @@ func parseMollyFiles(path string, docBase string, config UserConfig) UserConfig
 	config.PermRedirects = make(map[string]string)
 	config.MimeOverrides = make(map[string]string)
 	config.CertificateZones = make(map[string][]string)
+	config.CertificateValidityZones = make(map[string]string)
 
 	// Build list of directories to check
 	var dirs []string
@@ -232,7 +663,11 @@ func parseMollyFiles(path string, docBase string, config UserConfig) UserConfig
 			continue
 		}
 		// If the file exists and we can read it, try to parse it
+		parent := config
+		config.DeniedCertificates = nil
+		config.DeniedSerials = nil
 		config, err = readUserConfig(mollyPath, config, false)
+		addDenyLists(&config, parent)
 		if err != nil {
 			log.Println("Error parsing .molly file " + mollyPath + ": " + err.Error())
 			continue
@@ -4,18 +4,28 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-func handleCGI(config SysConfig, path string, cgiPath string, URL *url.URL, logEntry *LogEntry, conn net.Conn) {
+// The number of CGI processes currently running, for CGIMaxConcurrent.
+var runningCGIProcesses int32
+
+// Cancelled to kill any CGI processes still running when remaining
+// connections are cut off at shutdown.
+var cgiProcesses, cancelCGIProcesses = context.WithCancel(context.Background())
+
+func handleCGI(config SysConfig, path string, cgiPath string, URL *url.URL, upload *TitanUpload, remoteUser string, logEntry *LogEntry, conn net.Conn) {
 	// Find the shortest leading part of path which maps to an executable file.
 	// Call this part scriptPath, and everything after it pathInfo.
 	components := strings.Split(path, "/")
@@ -45,59 +55,216 @@ func handleCGI(config SysConfig, path string, cgiPath string, URL *url.URL, logE
 	}
 
 	// Prepare environment variables
-	vars := prepareCGIVariables(config, URL, conn, scriptPath, pathInfo)
+	vars := prepareCGIVariables(config, URL, conn, remoteUser, scriptPath, pathInfo)
+	if upload != nil {
+		prepareTitanVariables(vars, upload)
+	}
+
+	// Refuse to start too many processes at once
+	timeout := getCGITimeout(config, scriptPath)
+	running := atomic.AddInt32(&runningCGIProcesses, 1)
+	defer atomic.AddInt32(&runningCGIProcesses, -1)
+	if config.CGIMaxConcurrent > 0 && int(running) > config.CGIMaxConcurrent {
+		log.Println("Refusing to run CGI program " + path + " due to " + strconv.Itoa(config.CGIMaxConcurrent) + " CGI processes already running.")
+		conn.Write([]byte("44 " + strconv.Itoa(int(timeout.Seconds())) + "\r\n"))
+		logEntry.Status = 44
+		return
+	}
 
-	// Spawn process
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Spawn process, as the script's owner if it belongs to a user and
+	// this has been asked for
+	ctx, cancel := context.WithTimeout(cgiProcesses, timeout)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, scriptPath)
-	cmd.Env = []string{}
+	env := []string{}
 	for key, value := range vars {
-		cmd.Env = append(cmd.Env, key+"="+value)
+		env = append(env, key+"="+value)
 	}
-	response, err := cmd.Output()
-
-	if ctx.Err() == context.DeadlineExceeded {
-		log.Println("Terminating CGI process " + path + " due to exceeding 10 second runtime limit.")
-		conn.Write([]byte("42 CGI process timed out!\r\n"))
-		logEntry.Status = 42
-		return
+	var stdin io.Reader
+	if upload != nil {
+		stdin = io.LimitReader(upload.Body, upload.Size)
+	}
+	var stdout, stderr io.ReadCloser
+	var wait func() error
+	var err error
+	userScript, _ := isSubdir(scriptPath, filepath.Join(config.DocBase, config.HomeDocBase))
+	if config.UserCGIAsOwner && userScript {
+		stdout, stderr, wait, err = cgiHelper.start(ctx, scriptPath, env, stdin, getCGILimits(config))
+	} else {
+		stdout, stderr, wait, err = startCGIProcess(ctx, scriptPath, env, stdin, getCGILimits(config))
+	}
+	if err == nil {
+		// Copy stderr to the error log as it arrives
+		stderrDone := make(chan struct{})
+		go func() {
+			scanner := bufio.NewScanner(stderr)
+			for scanner.Scan() {
+				log.Println("CGI process " + path + " stderr: " + scanner.Text())
+			}
+			close(stderrDone)
+		}()
+		defer func() {
+			// All reading must be finished before calling Wait
+			stdout.Close()
+			<-stderrDone
+			stderr.Close()
+			err := wait()
+			if ctx.Err() == context.DeadlineExceeded {
+				log.Println("Terminating CGI process " + path + " due to exceeding " + timeout.String() + " runtime limit.")
+			} else if err != nil {
+				log.Println("Error running CGI program " + path + ": " + err.Error())
+			}
+		}()
 	}
 	if err != nil {
-		log.Println("Error running CGI program " + path + ": " + err.Error())
-		if err, ok := err.(*exec.ExitError); ok {
-			log.Println("↳ stderr output: " + string(err.Stderr))
-		}
+		log.Println("Error starting CGI program " + path + ": " + err.Error())
 		conn.Write([]byte("42 CGI error!\r\n"))
 		logEntry.Status = 42
 		return
 	}
+
 	// Extract response header
-	responseString := string(response)
-	if len(responseString) == 0 {
-		log.Println("Received no response from CGI process " + path)
-		conn.Write([]byte("42 CGI error!\r\n"))
+	reader := bufio.NewReaderSize(stdout, 1029)
+	header, err := reader.ReadSlice('\n')
+	if len(header) == 0 && err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			conn.Write([]byte("42 CGI process timed out!\r\n"))
+		} else {
+			log.Println("Received no response from CGI process " + path)
+			conn.Write([]byte("42 CGI error!\r\n"))
+		}
 		logEntry.Status = 42
 		return
 	}
-	header, _, _ := bufio.NewReader(strings.NewReader(string(response))).ReadLine()
-	status, err := strconv.Atoi(strings.Fields(string(header))[0])
+	status, err := parseResponseHeader(header)
 	if err != nil {
-		log.Println("Unable to parse first line of output from CGI process " + path + " as valid Gemini response header.  Line was: " + string(header))
+		cancel()
+		log.Println("Unable to parse first line of output from CGI process " + path + " as valid Gemini response header.  Line was: " + strings.TrimRight(string(header), "\r\n"))
 		conn.Write([]byte("42 CGI error!\r\n"))
 		logEntry.Status = 42
 		return
 	}
 	logEntry.Status = status
 
-	// Write response
-	conn.Write(response)
+	// Stream response, giving up on slow clients when the process would
+	// be killed anyway
+	deadline, _ := ctx.Deadline()
+	conn.SetWriteDeadline(deadline)
+	conn.Write(header)
+	var output io.Reader = reader
+	if config.CGIMaxOutput > 0 {
+		output = io.LimitReader(reader, config.CGIMaxOutput)
+	}
+	_, err = io.Copy(conn, output)
+	if err != nil && ctx.Err() == nil {
+		log.Println("Error relaying output of CGI process " + path + " to " + conn.RemoteAddr().String() + ": " + err.Error())
+	} else if err == nil && config.CGIMaxOutput > 0 {
+		_, err = reader.ReadByte()
+		if err == nil {
+			cancel()
+			log.Println("Terminating CGI process " + path + " due to exceeding " + strconv.FormatInt(config.CGIMaxOutput, 10) + " byte output limit.")
+		}
+	}
+}
+
+// Start the CGI script at scriptPath as a child process, subject to limits,
+// which is killed along with any children of its own when ctx is done.  The
+// returned function waits for the script to exit, and must be called after
+// stdout and stderr have been read.
+func startCGIProcess(ctx context.Context, scriptPath string, env []string, stdin io.Reader, limits CGILimits) (io.ReadCloser, io.ReadCloser, func() error, error) {
+	cmd := exec.Command(scriptPath)
+	cmd.Env = env
+	cmd.Stdin = stdin
+	started, err := limitCGICommand(cmd, limits)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer started()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return stdout, stderr, watchCGIProcess(ctx, cmd), nil
+}
+
+// Kill the process started by cmd when ctx is done.  The returned function
+// waits for it to exit.
+func watchCGIProcess(ctx context.Context, cmd *exec.Cmd) func() error {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killCGIProcess(cmd)
+		case <-done:
+		}
+	}()
+	return func() error {
+		err := cmd.Wait()
+		close(done)
+		return err
+	}
+}
+
+// Resource limits applied to each CGI process.  Zero means no limit.
+type CGILimits struct {
+	CPUTime   int64
+	Memory    int64
+	OpenFiles int64
+	Processes int64
+}
+
+func getCGILimits(config SysConfig) CGILimits {
+	return CGILimits{config.CGIMaxCPUTime, config.CGIMaxMemory, config.CGIMaxOpenFiles, config.CGIMaxProcesses}
+}
+
+// Find the runtime limit for the CGI script at scriptPath, using the longest
+// matching CGIPathTimeouts prefix if there is one.
+func getCGITimeout(config SysConfig, scriptPath string) time.Duration {
+	timeout := config.CGITimeout
+	longest := -1
+	for prefix, prefixTimeout := range config.CGIPathTimeouts {
+		if strings.HasPrefix(scriptPath, prefix) && len(prefix) > longest {
+			timeout = prefixTimeout
+			longest = len(prefix)
+		}
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// Check that header is a valid Gemini response header line, i.e. a two digit
+// status code, optionally followed by a space and a meta string of at most
+// 1024 bytes, terminated by a line ending.  Bare LF line endings are
+// accepted.  The status code is returned.
+func parseResponseHeader(header []byte) (int, error) {
+	line := strings.TrimSuffix(string(header), "\n")
+	if len(line) == len(header) {
+		return 0, errors.New("Response header not terminated by a line ending")
+	}
+	line = strings.TrimSuffix(line, "\r")
+	if len(line) < 2 || line[0] < '1' || line[0] > '6' || line[1] < '0' || line[1] > '9' {
+		return 0, errors.New("Invalid response status code")
+	}
+	if len(line) > 2 && line[2] != ' ' {
+		return 0, errors.New("Response status code not followed by a space")
+	}
+	if len(line) > 3+1024 {
+		return 0, errors.New("Response meta exceeds 1024 bytes")
+	}
+	status, _ := strconv.Atoi(line[0:2])
+	return status, nil
 }
 
-func handleSCGI(URL *url.URL, scgiPath string, scgiSocket string, config SysConfig, logEntry *LogEntry, conn net.Conn) {
+func handleSCGI(URL *url.URL, scgiPath string, scgiSocket string, config SysConfig, remoteUser string, logEntry *LogEntry, conn net.Conn) {
 
 	// Connect to socket
-	socket, err := net.Dial("unix", scgiSocket)
+	socket, err := dialGateway(scgiSocket, config)
 	if err != nil {
 		log.Println("Error connecting to SCGI socket " + scgiSocket + ": " + err.Error())
 		conn.Write([]byte("42 Error connecting to SCGI service!\r\n"))
@@ -106,66 +273,92 @@ func handleSCGI(URL *url.URL, scgiPath string, scgiSocket string, config SysConf
 	}
 	defer socket.Close()
 
-	// Send variables
-	vars := prepareSCGIVariables(config, URL, scgiPath, conn)
-	length := 0
+	// Send variables as a netstring, with CONTENT_LENGTH first as
+	// required by the SCGI spec
+	vars := prepareSCGIVariables(config, URL, scgiPath, conn, remoteUser)
+	headers := "CONTENT_LENGTH\x00" + vars["CONTENT_LENGTH"] + "\x00"
+	delete(vars, "CONTENT_LENGTH")
 	for key, value := range vars {
-		length += len(key)
-		length += len(value)
-		length += 2
+		headers += key + "\x00" + value + "\x00"
 	}
-	socket.Write([]byte(strconv.Itoa(length) + ":"))
-	for key, value := range vars {
-		socket.Write([]byte(key + "\x00"))
-		socket.Write([]byte(value + "\x00"))
+	_, err = socket.Write([]byte(strconv.Itoa(len(headers)) + ":" + headers + ","))
+	if err != nil {
+		log.Println("Error writing to SCGI socket " + scgiSocket + ": " + err.Error())
+		conn.Write([]byte("42 Error writing to SCGI service!\r\n"))
+		logEntry.Status = 42
+		return
 	}
-	socket.Write([]byte(","))
 
-	// Read and relay response
-	buffer := make([]byte, 1027)
-	first := true
-	for {
-		n, err := socket.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else if !first {
-				// Err
-				log.Println("Error reading from SCGI socket " + scgiSocket + ": " + err.Error())
-				conn.Write([]byte("42 Error reading from SCGI service!\r\n"))
-				logEntry.Status = 42
-				return
-			} else {
-				break
-			}
-		}
-		// Extract status code from first line
-		if first {
-			first = false
-			lines := strings.SplitN(string(buffer), "\r\n", 2)
-			status, err := strconv.Atoi(strings.Fields(lines[0])[0])
-			if err != nil {
-				conn.Write([]byte("42 CGI error!\r\n"))
-				logEntry.Status = 42
-				return
-			}
-			logEntry.Status = status
-		}
-		// Send to client
-		conn.Write(buffer[:n])
+	// Read until a complete header line has arrived
+	reader := bufio.NewReaderSize(socket, 1029)
+	header, err := reader.ReadSlice('\n')
+	if len(header) == 0 && err != nil {
+		log.Println("Error reading from SCGI socket " + scgiSocket + ": " + err.Error())
+		conn.Write([]byte("42 Error reading from SCGI service!\r\n"))
+		logEntry.Status = 42
+		return
+	}
+
+	// Extract status code from first line
+	status, err := parseResponseHeader(header)
+	if err != nil {
+		log.Println("Unable to parse first line of output from SCGI socket " + scgiSocket + " as valid Gemini response header: " + err.Error())
+		conn.Write([]byte("42 CGI error!\r\n"))
+		logEntry.Status = 42
+		return
 	}
+	logEntry.Status = status
+
+	// Relay the rest of the response
+	conn.Write(header)
+	_, err = io.Copy(conn, reader)
+	if err != nil {
+		log.Println("Error relaying response from SCGI socket " + scgiSocket + ": " + err.Error())
+	}
+}
+
+// Connect to a gateway application at address, which is either a path to a
+// unix domain socket or a tcp://host:port URL.
+func dialGateway(address string, config SysConfig) (net.Conn, error) {
+	network := "unix"
+	if strings.HasPrefix(address, "tcp://") {
+		network = "tcp"
+		address = strings.TrimPrefix(address, "tcp://")
+	}
+	socket, err := net.DialTimeout(network, address, time.Duration(config.GatewayConnectTimeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &gatewayConn{socket, time.Duration(config.GatewayReadTimeout) * time.Second}, nil
+}
+
+// A connection to a gateway application which gives up on any read or write
+// which makes no progress for longer than timeout.
+type gatewayConn struct {
+	net.Conn
+	timeout time.Duration
 }
 
-func prepareCGIVariables(config SysConfig, URL *url.URL, conn net.Conn, script_path string, path_info string) map[string]string {
-	vars := prepareGatewayVariables(config, URL, conn)
+func (gc *gatewayConn) Read(buffer []byte) (int, error) {
+	gc.Conn.SetReadDeadline(time.Now().Add(gc.timeout))
+	return gc.Conn.Read(buffer)
+}
+
+func (gc *gatewayConn) Write(buffer []byte) (int, error) {
+	gc.Conn.SetWriteDeadline(time.Now().Add(gc.timeout))
+	return gc.Conn.Write(buffer)
+}
+
+func prepareCGIVariables(config SysConfig, URL *url.URL, conn net.Conn, remoteUser string, script_path string, path_info string) map[string]string {
+	vars := prepareGatewayVariables(config, URL, conn, remoteUser)
 	vars["GATEWAY_INTERFACE"] = "CGI/1.1"
 	vars["SCRIPT_PATH"] = script_path
 	vars["PATH_INFO"] = path_info
 	return vars
 }
 
-func prepareSCGIVariables(config SysConfig, URL *url.URL, scgiPath string, conn net.Conn) map[string]string {
-	vars := prepareGatewayVariables(config, URL, conn)
+func prepareSCGIVariables(config SysConfig, URL *url.URL, scgiPath string, conn net.Conn, remoteUser string) map[string]string {
+	vars := prepareGatewayVariables(config, URL, conn, remoteUser)
 	vars["SCGI"] = "1"
 	vars["CONTENT_LENGTH"] = "0"
 	vars["SCRIPT_PATH"] = scgiPath
@@ -173,7 +366,21 @@ func prepareSCGIVariables(config SysConfig, URL *url.URL, scgiPath string, conn
 	return vars
 }
 
-func prepareGatewayVariables(config SysConfig, URL *url.URL, conn net.Conn) map[string]string {
+func prepareFastCGIVariables(config SysConfig, URL *url.URL, fcgiPath string, conn net.Conn, remoteUser string) map[string]string {
+	vars := prepareGatewayVariables(config, URL, conn, remoteUser)
+	vars["GATEWAY_INTERFACE"] = "CGI/1.1"
+	// Many FastCGI applications and libraries refuse requests without one
+	vars["REQUEST_METHOD"] = "GET"
+	vars["CONTENT_LENGTH"] = "0"
+	vars["SCRIPT_PATH"] = fcgiPath
+	vars["SCRIPT_NAME"] = fcgiPath
+	vars["SCRIPT_FILENAME"] = resolvePath(URL.Path, config)
+	vars["PATH_INFO"] = URL.Path[len(fcgiPath):]
+	vars["REQUEST_URI"] = URL.RequestURI()
+	return vars
+}
+
+func prepareGatewayVariables(config SysConfig, URL *url.URL, conn net.Conn, remoteUser string) map[string]string {
 	vars := make(map[string]string)
 	vars["QUERY_STRING"] = URL.RawQuery
 	vars["REQUEST_METHOD"] = ""
@@ -195,12 +402,17 @@ func prepareGatewayVariables(config SysConfig, URL *url.URL, conn net.Conn) map[
 	if len(clientCerts) > 0 {
 		cert := clientCerts[0]
 		vars["TLS_CLIENT_HASH"] = getCertFingerprint(cert)
+		vars["TLS_CLIENT_PUBKEY_HASH"] = getPublicKeyFingerprint(cert)
 		vars["TLS_CLIENT_ISSUER"] = cert.Issuer.String()
 		vars["TLS_CLIENT_ISSUER_CN"] = cert.Issuer.CommonName
 		vars["TLS_CLIENT_SUBJECT"] = cert.Subject.String()
 		vars["TLS_CLIENT_SUBJECT_CN"] = cert.Subject.CommonName
 		// To make it easier to detect when a cert is present
 		vars["AUTH_TYPE"] = "Certificate"
+		// The name of the identity the cert was authorised as, if any
+		if remoteUser != "" {
+			vars["REMOTE_USER"] = remoteUser
+		}
 	}
 	return vars
 }
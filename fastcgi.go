@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// FastCGI record types and other protocol constants, from the FastCGI
+// specification.
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	fcgiKeepConn     = 1
+	fcgiRequestID    = 1
+	fcgiMaxContent   = 65535
+	fcgiMaxIdleConns = 4
+)
+
+// Idle connections to FastCGI applications, kept open for reuse.
+type FastCGIPool struct {
+	mu   sync.Mutex
+	idle map[string][]net.Conn
+}
+
+var fastCGIPool = FastCGIPool{idle: make(map[string][]net.Conn)}
+
+// Return an idle connection to address if there is one, otherwise a new one.
+// The boolean return value reports whether the connection was reused.
+func (pool *FastCGIPool) get(address string, config SysConfig) (net.Conn, bool, error) {
+	pool.mu.Lock()
+	conns := pool.idle[address]
+	if len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		pool.idle[address] = conns[:len(conns)-1]
+		pool.mu.Unlock()
+		return conn, true, nil
+	}
+	pool.mu.Unlock()
+	conn, err := dialGateway(address, config)
+	return conn, false, err
+}
+
+func (pool *FastCGIPool) put(address string, conn net.Conn) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.idle[address]) >= fcgiMaxIdleConns {
+		conn.Close()
+		return
+	}
+	pool.idle[address] = append(pool.idle[address], conn)
+}
+
+func handleFastCGI(URL *url.URL, fcgiPath string, fcgiAddress string, config SysConfig, remoteUser string, logEntry *LogEntry, conn net.Conn) {
+
+	vars := prepareFastCGIVariables(config, URL, fcgiPath, conn, remoteUser)
+
+	// Send the request over a pooled connection if possible, but if the
+	// application has closed it in the meantime, try again with a fresh one
+	var socket net.Conn
+	var response *fastCGIReader
+	var header []byte
+	reused := true
+	for reused {
+		var err error
+		if response == nil {
+			socket, reused, err = fastCGIPool.get(fcgiAddress, config)
+		} else {
+			socket, err = dialGateway(fcgiAddress, config)
+			reused = false
+		}
+		if err != nil {
+			log.Println("Error connecting to FastCGI application " + fcgiAddress + ": " + err.Error())
+			conn.Write([]byte("42 Error connecting to FastCGI service!\r\n"))
+			logEntry.Status = 42
+			return
+		}
+		response = newFastCGIReader(socket, fcgiAddress)
+		err = writeFastCGIRequest(socket, vars)
+		if err == nil {
+			header, err = response.reader.ReadSlice('\n')
+		}
+		if err == nil {
+			break
+		}
+		socket.Close()
+		if reused && len(header) == 0 {
+			continue
+		}
+		log.Println("Error reading from FastCGI application " + fcgiAddress + ": " + err.Error())
+		conn.Write([]byte("42 Error reading from FastCGI service!\r\n"))
+		logEntry.Status = 42
+		return
+	}
+
+	// Extract status code from first line, translating CGI-style headers
+	// as produced by e.g. PHP if necessary
+	status, err := parseResponseHeader(header)
+	if err != nil && isCGIHeaderLine(header) {
+		header, err = translateCGIHeaders(header, response.reader)
+		if err == nil {
+			status, err = parseResponseHeader(header)
+		}
+	}
+	if err != nil {
+		socket.Close()
+		log.Println("Unable to parse first line of output from FastCGI application " + fcgiAddress + " as valid Gemini response header: " + err.Error())
+		conn.Write([]byte("42 CGI error!\r\n"))
+		logEntry.Status = 42
+		return
+	}
+	logEntry.Status = status
+
+	// Relay the rest of the response, and keep the connection for reuse
+	// if everything up to the end of the request was read
+	conn.Write(header)
+	_, err = io.Copy(conn, response.reader)
+	if err == nil && response.ended {
+		fastCGIPool.put(fcgiAddress, socket)
+	} else {
+		if err != nil && response.err != nil {
+			log.Println("Error reading from FastCGI application " + fcgiAddress + ": " + err.Error())
+		}
+		socket.Close()
+	}
+}
+
+var cgiHeaderLineRegex = regexp.MustCompile(`^[A-Za-z0-9-]+:`)
+
+func isCGIHeaderLine(line []byte) bool {
+	return cgiHeaderLineRegex.Match(line)
+}
+
+// Read the block of CGI-style headers which begins with first, and build
+// an equivalent Gemini response header.  A Status header whose value is a
+// Gemini status and meta is used as is, otherwise the response is treated as
+// a success with the given Content-Type.
+func translateCGIHeaders(first []byte, reader *bufio.Reader) ([]byte, error) {
+	status := ""
+	contentType := "text/gemini"
+	line := string(first)
+	for count := 0; ; count++ {
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if count == 100 || !isCGIHeaderLine([]byte(line)) {
+			return nil, errors.New("Malformed CGI headers")
+		}
+		keyValue := strings.SplitN(line, ":", 2)
+		value := strings.TrimSpace(keyValue[1])
+		switch strings.ToLower(keyValue[0]) {
+		case "status":
+			status = value
+		case "content-type":
+			contentType = value
+		}
+		next, err := reader.ReadSlice('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = string(next)
+	}
+	if status != "" {
+		return []byte(status + "\r\n"), nil
+	}
+	return []byte("20 " + contentType + "\r\n"), nil
+}
+
+func writeFastCGIRequest(socket net.Conn, vars map[string]string) error {
+	// Buffer the whole request so it goes out in as few writes as possible
+	writer := bufio.NewWriter(socket)
+
+	begin := []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0}
+	writeFastCGIRecord(writer, fcgiBeginRequest, begin)
+
+	var params []byte
+	for key, value := range vars {
+		params = appendFastCGILength(params, len(key))
+		params = appendFastCGILength(params, len(value))
+		params = append(params, key...)
+		params = append(params, value...)
+	}
+	for len(params) > fcgiMaxContent {
+		writeFastCGIRecord(writer, fcgiParams, params[:fcgiMaxContent])
+		params = params[fcgiMaxContent:]
+	}
+	if len(params) > 0 {
+		writeFastCGIRecord(writer, fcgiParams, params)
+	}
+	writeFastCGIRecord(writer, fcgiParams, nil)
+	writeFastCGIRecord(writer, fcgiStdin, nil)
+	return writer.Flush()
+}
+
+func writeFastCGIRecord(writer *bufio.Writer, recordType byte, content []byte) {
+	header := []byte{fcgiVersion, recordType, 0, fcgiRequestID, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	writer.Write(header)
+	writer.Write(content)
+}
+
+func appendFastCGILength(buffer []byte, length int) []byte {
+	if length < 128 {
+		return append(buffer, byte(length))
+	}
+	var encoded [4]byte
+	binary.BigEndian.PutUint32(encoded[:], uint32(length)|0x80000000)
+	return append(buffer, encoded[:]...)
+}
+
+// Presents the STDOUT stream of a FastCGI response as a plain io.Reader,
+// copying STDERR to the error log and stopping at END_REQUEST.
+type fastCGIReader struct {
+	socket  net.Conn
+	address string
+	reader  *bufio.Reader
+	pending int
+	padding int
+	ended   bool
+	err     error
+}
+
+func newFastCGIReader(socket net.Conn, address string) *fastCGIReader {
+	response := &fastCGIReader{socket: socket, address: address}
+	response.reader = bufio.NewReaderSize(response, 1029)
+	return response
+}
+
+func (response *fastCGIReader) Read(buffer []byte) (int, error) {
+	for response.pending == 0 {
+		if response.ended {
+			return 0, io.EOF
+		}
+		// The response only ends cleanly with END_REQUEST
+		err := response.nextRecord()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			response.err = err
+			return 0, err
+		}
+	}
+	if len(buffer) > response.pending {
+		buffer = buffer[:response.pending]
+	}
+	n, err := response.socket.Read(buffer)
+	response.pending -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		response.err = err
+	}
+	return n, err
+}
+
+// Read record headers until one with STDOUT content is found, handling any
+// other records on the way.
+func (response *fastCGIReader) nextRecord() error {
+	// Skip the padding of the previous record
+	if response.padding > 0 {
+		_, err := io.CopyN(ioutil.Discard, response.socket, int64(response.padding))
+		if err != nil {
+			return err
+		}
+		response.padding = 0
+	}
+
+	var header [8]byte
+	_, err := io.ReadFull(response.socket, header[:])
+	if err != nil {
+		return err
+	}
+	if header[0] != fcgiVersion {
+		return errors.New("Unsupported FastCGI protocol version")
+	}
+	length := int(binary.BigEndian.Uint16(header[4:6]))
+	response.padding = int(header[6])
+
+	switch header[1] {
+	case fcgiStdout:
+		response.pending = length
+	case fcgiStderr:
+		content := make([]byte, length)
+		_, err = io.ReadFull(response.socket, content)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			if line != "" {
+				log.Println("FastCGI application " + response.address + " stderr: " + line)
+			}
+		}
+	case fcgiEndRequest:
+		_, err = io.CopyN(ioutil.Discard, response.socket, int64(length+response.padding))
+		if err != nil {
+			return err
+		}
+		response.padding = 0
+		response.ended = true
+	default:
+		_, err = io.CopyN(ioutil.Discard, response.socket, int64(length))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
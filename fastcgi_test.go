@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// Build a FastCGI record with the given version, type, content and amount
+// of padding.
+func fastCGIRecord(version byte, recordType byte, content string, padding int) []byte {
+	header := []byte{version, recordType, 0, fcgiRequestID, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	record := append(header, content...)
+	return append(record, make([]byte, padding)...)
+}
+
+func TestFastCGIReader(t *testing.T) {
+	end := fastCGIRecord(fcgiVersion, fcgiEndRequest, "\x00\x00\x00\x00\x00\x00\x00\x00", 0)
+	tests := []struct {
+		name    string
+		records [][]byte
+		output  string
+		invalid bool
+	}{
+		{"single record", [][]byte{
+			fastCGIRecord(fcgiVersion, fcgiStdout, "20 text/gemini\r\nhello", 0),
+			fastCGIRecord(fcgiVersion, fcgiStdout, "", 0),
+			end,
+		}, "20 text/gemini\r\nhello", false},
+		{"several records with padding", [][]byte{
+			fastCGIRecord(fcgiVersion, fcgiStdout, "20 text/gemini\r\n", 3),
+			fastCGIRecord(fcgiVersion, fcgiStdout, "hello ", 7),
+			fastCGIRecord(fcgiVersion, fcgiStdout, "world", 0),
+			fastCGIRecord(fcgiVersion, fcgiEndRequest, "\x00\x00\x00\x00\x00\x00\x00\x00", 4),
+		}, "20 text/gemini\r\nhello world", false},
+		{"stderr and unknown records skipped", [][]byte{
+			fastCGIRecord(fcgiVersion, fcgiStderr, "warning\n", 2),
+			fastCGIRecord(fcgiVersion, fcgiStdout, "20 text/gemini\r\n", 0),
+			fastCGIRecord(fcgiVersion, 11, "unknown", 1),
+			fastCGIRecord(fcgiVersion, fcgiStdout, "hello", 0),
+			end,
+		}, "20 text/gemini\r\nhello", false},
+		{"end without output", [][]byte{end}, "", false},
+		{"missing end", [][]byte{
+			fastCGIRecord(fcgiVersion, fcgiStdout, "20 text/gemini\r\n", 0),
+		}, "", true},
+		{"truncated content", [][]byte{
+			fastCGIRecord(fcgiVersion, fcgiStdout, "20 text/gemini\r\n", 0)[:12],
+		}, "", true},
+		{"truncated header", [][]byte{
+			fastCGIRecord(fcgiVersion, fcgiStdout, "", 0)[:5],
+		}, "", true},
+		{"truncated padding", [][]byte{
+			fastCGIRecord(fcgiVersion, fcgiStdout, "20 text/gemini\r\n", 8)[:26],
+		}, "", true},
+		{"truncated stderr", [][]byte{
+			fastCGIRecord(fcgiVersion, fcgiStderr, "warning\n", 0)[:10],
+		}, "", true},
+		{"wrong version", [][]byte{
+			fastCGIRecord(2, fcgiStdout, "20 text/gemini\r\n", 0),
+			end,
+		}, "", true},
+		{"nothing", nil, "", true},
+	}
+	for _, test := range tests {
+		server, client := net.Pipe()
+		go func(records [][]byte) {
+			server.Write(bytes.Join(records, nil))
+			server.Close()
+		}(test.records)
+		output, err := ioutil.ReadAll(newFastCGIReader(client, "test").reader)
+		client.Close()
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got output %q", test.name, output)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if string(output) != test.output {
+			t.Errorf("%s: expected output %q, got %q", test.name, test.output, output)
+		}
+	}
+}
+
+// The reader must stop at END_REQUEST, leaving the connection ready to be
+// reused for the next request.
+func TestFastCGIReaderStopsAtEnd(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write(fastCGIRecord(fcgiVersion, fcgiStdout, "20 text/gemini\r\n", 2))
+		server.Write(fastCGIRecord(fcgiVersion, fcgiEndRequest, "\x00\x00\x00\x00\x00\x00\x00\x00", 0))
+		server.Write([]byte("next"))
+		server.Close()
+	}()
+	output, err := ioutil.ReadAll(newFastCGIReader(client, "test").reader)
+	if err != nil || string(output) != "20 text/gemini\r\n" {
+		t.Fatalf("expected output %q, got %q and error %v", "20 text/gemini\r\n", output, err)
+	}
+	next := make([]byte, 4)
+	_, err = io.ReadFull(client, next)
+	if err != nil || string(next) != "next" {
+		t.Errorf("expected %q left on the connection, got %q and error %v", "next", next, err)
+	}
+}
+
+func TestAppendFastCGILength(t *testing.T) {
+	tests := []struct {
+		length  int
+		encoded []byte
+	}{
+		{0, []byte{0}},
+		{127, []byte{127}},
+		{128, []byte{0x80, 0, 0, 128}},
+		{65535, []byte{0x80, 0, 0xff, 0xff}},
+	}
+	for _, test := range tests {
+		encoded := appendFastCGILength(nil, test.length)
+		if !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("length %d: expected %v, got %v", test.length, test.encoded, encoded)
+		}
+	}
+}
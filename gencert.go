@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A TLS keypair named in the config, along with the hostnames of the main
+// host or virtual hosts which use it.
+type keypair struct {
+	certPath  string
+	keyPath   string
+	hostnames []string
+}
+
+func getKeypairs(config SysConfig) []*keypair {
+	keypairs := []*keypair{&keypair{config.CertPath, config.KeyPath, []string{config.Hostname}}}
+	for _, vhost := range config.VirtualHosts {
+		var existing *keypair
+		for _, kp := range keypairs {
+			if kp.certPath == vhost.CertPath && kp.keyPath == vhost.KeyPath {
+				existing = kp
+			}
+		}
+		if existing == nil {
+			keypairs = append(keypairs, &keypair{vhost.CertPath, vhost.KeyPath, nil})
+			existing = keypairs[len(keypairs)-1]
+		}
+		existing.hostnames = append(existing.hostnames, vhost.Hostnames...)
+	}
+	return keypairs
+}
+
+// Generate a self-signed certificate and key for each keypair named in
+// config whose files don't exist yet, covering the hostnames of the main
+// host or virtual hosts which use it.  Existing files are never replaced.
+func generateCertificates(config SysConfig) error {
+	for _, kp := range getKeypairs(config) {
+		_, certErr := os.Stat(kp.certPath)
+		_, keyErr := os.Stat(kp.keyPath)
+		if certErr == nil && keyErr == nil {
+			continue
+		} else if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+			log.Println("Not generating a certificate as only one of " + kp.certPath + " and " + kp.keyPath + " is missing")
+			return errors.New("Incomplete TLS keypair")
+		}
+		err := generateCertificate(kp.certPath, kp.keyPath, kp.hostnames, config.AutoCertificateType, config.AutoCertificateDays)
+		if err != nil {
+			log.Println("Error generating TLS certificate " + kp.certPath + ": " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+func generateCertificate(certPath string, keyPath string, hostnames []string, keyType string, days int) error {
+	var public crypto.PublicKey
+	var private crypto.PrivateKey
+	var err error
+	switch keyType {
+	case "ecdsa":
+		var key *ecdsa.PrivateKey
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		public, private = key.Public(), key
+	case "ed25519":
+		public, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return errors.New("Invalid AutoCertificateType " + keyType + ", must be ecdsa or ed25519")
+	}
+	if err != nil {
+		return err
+	}
+
+	certDer, err := selfSign(hostnames, public, private, days)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	// Write the key first, so a certificate is never left without one
+	err = writePEMFile(keyPath, "PRIVATE KEY", keyDer, 0600)
+	if err != nil {
+		return err
+	}
+	err = writePEMFile(certPath, "CERTIFICATE", certDer, 0644)
+	if err != nil {
+		os.Remove(keyPath)
+		return err
+	}
+	cert, _ := x509.ParseCertificate(certDer)
+	log.Println("Generated self-signed " + keyType + " certificate " + certPath + " for " + strings.Join(hostnames, ", ") + ", valid for " + strconv.Itoa(days) + " days, with fingerprint " + getCertFingerprint(cert) + ".")
+	return nil
+}
+
+// Create a certificate for hostnames, valid for the given number of days
+// from now, signed by its own key.
+func selfSign(hostnames []string, public crypto.PublicKey, private crypto.PrivateKey, days int) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostnames[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(0, 0, days),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, hostname := range hostnames {
+		ip := net.ParseIP(hostname)
+		if ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, hostname)
+		}
+	}
+	return x509.CreateCertificate(rand.Reader, &template, &template, public, private)
+}
+
+func writePEMFile(path string, blockType string, der []byte, perm os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(file, &pem.Block{Type: blockType, Bytes: der})
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
@@ -3,6 +3,7 @@ module tildegit.org/solderpunk/molly-brown
 go 1.15
 
 require (
-	github.com/BurntSushi/toml v1.2.1 // indirect
-	golang.org/x/sys v0.5.0 // indirect
+	github.com/BurntSushi/toml v1.2.1
+	golang.org/x/crypto v0.6.0
+	golang.org/x/sys v0.5.0
 )
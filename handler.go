@@ -51,8 +51,7 @@ func handleGeminiRequest(conn net.Conn, sysConfig SysConfig, config UserConfig,
 
 	// Enforce rate limiting
 	if sysConfig.RateLimitEnable {
-		noPort := logEntry.RemoteAddr.String()
-		noPort = noPort[0:strings.LastIndex(noPort, ":")]
+		noPort := remoteHost(logEntry.RemoteAddr)
 		limited := rl.hardLimited(noPort)
 		if limited {
 			conn.Close()
@@ -67,20 +66,14 @@ func handleGeminiRequest(conn net.Conn, sysConfig SysConfig, config UserConfig,
 	}
 
 	// Read request
-	URL, err := readRequest(conn, &logEntry)
+	reader := bufio.NewReaderSize(conn, 1024)
+	URL, err := readRequest(conn, reader, &logEntry)
 	if err != nil {
 		return
 	}
 
-	// Enforce client certificate validity
-	clientCerts := tlsConn.ConnectionState().PeerCertificates
-	enforceCertificateValidity(clientCerts, conn, &logEntry)
-	if logEntry.Status != 0 {
-		return
-	}
-
 	// Reject non-gemini schemes
-	if URL.Scheme != "gemini" {
+	if URL.Scheme != "gemini" && URL.Scheme != "titan" {
 		conn.Write([]byte("53 No proxying to non-Gemini content!\r\n"))
 		logEntry.Status = 53
 		return
@@ -92,12 +85,24 @@ func handleGeminiRequest(conn net.Conn, sysConfig SysConfig, config UserConfig,
 	if strings.HasSuffix(requestedHost, ".") {
 		requestedHost = requestedHost[:len(requestedHost)-1]
 	}
-	if requestedHost != sysConfig.Hostname || (URL.Port() != "" && URL.Port() != strconv.Itoa(sysConfig.Port)) {
+	sysConfig, config, known := selectVirtualHost(requestedHost, sysConfig, config)
+	if !known || (URL.Port() != "" && URL.Port() != strconv.Itoa(sysConfig.Port)) {
 		conn.Write([]byte("53 No proxying to other hosts or ports!\r\n"))
 		logEntry.Status = 53
 		return
 	}
 
+	// Separate Titan parameters from the path
+	var upload *TitanUpload
+	if URL.Scheme == "titan" {
+		upload, err = parseTitanParameters(URL, reader)
+		if err != nil {
+			conn.Write([]byte("59 Invalid Titan parameters!\r\n"))
+			logEntry.Status = 59
+			return
+		}
+	}
+
 	// Fail if there are dots in the path
 	if strings.Contains(URL.Path, "..") {
 		conn.Write([]byte("50 Your directory traversal technique has been defeated!\r\n"))
@@ -105,11 +110,60 @@ func handleGeminiRequest(conn net.Conn, sysConfig SysConfig, config UserConfig,
 		return
 	}
 
+	// Enforce client certificate validity
+	clientCerts := tlsConn.ConnectionState().PeerCertificates
+	enforceCertificateValidity(URL, clientCerts, config, conn, &logEntry)
+	if logEntry.Status != 0 {
+		return
+	}
+
+	// Refuse denied client certificates
+	enforceCertificateDenyList(clientCerts, sysConfig, config, conn, &logEntry)
+	if logEntry.Status != 0 {
+		return
+	}
+
+	// Handle uploads separately from ordinary requests, but only after
+	// applying any validity policies and denied certs from Molly files
+	if upload != nil {
+		if sysConfig.ReadMollyFiles {
+			mollyConfig := parseMollyFiles(resolvePath(URL.Path, sysConfig), sysConfig.DocBase, config)
+			enforceCertificateValidity(URL, clientCerts, mollyConfig, conn, &logEntry)
+			if logEntry.Status != 0 {
+				return
+			}
+			enforceCertificateDenyList(clientCerts, sysConfig, mollyConfig, conn, &logEntry)
+			if logEntry.Status != 0 {
+				return
+			}
+		}
+		handleTitan(URL, upload, clientCerts, sysConfig, &logEntry, conn)
+		return
+	}
+
 	// Check whether this URL is in a certificate zone
-	handleCertificateZones(URL, clientCerts, config, conn, &logEntry)
+	remoteUser := handleCertificateZones(URL, clientCerts, sysConfig, config, conn, &logEntry)
 	if logEntry.Status != 0 {
 		return
 	}
+	handleCAZones(URL, clientCerts, sysConfig, conn, &logEntry)
+	if logEntry.Status != 0 {
+		return
+	}
+	registeredUser := handleRegistrationZones(URL, clientCerts, sysConfig, conn, &logEntry)
+	if logEntry.Status != 0 {
+		return
+	}
+	if registeredUser != "" {
+		remoteUser = registeredUser
+	}
+	passwordUser := handlePasswordZones(URL, clientCerts, sysConfig, conn, &logEntry)
+	if logEntry.Status != 0 {
+		return
+	}
+	if passwordUser != "" {
+		remoteUser = passwordUser
+	}
 
 	// Check for redirects
 	handleRedirects(URL, config, conn, &logEntry)
@@ -126,11 +180,23 @@ func handleGeminiRequest(conn net.Conn, sysConfig SysConfig, config UserConfig,
 	// *does* exist on disk!
 	if sysConfig.ReadMollyFiles {
 		config = parseMollyFiles(path, sysConfig.DocBase, config)
-		// We may have picked up new cert zones and/or redirects above, so:
-		handleCertificateZones(URL, clientCerts, config, conn, &logEntry)
+		// We may have picked up new validity policies, denied certs, cert
+		// zones and/or redirects above, so:
+		enforceCertificateValidity(URL, clientCerts, config, conn, &logEntry)
 		if logEntry.Status != 0 {
 			return
 		}
+		enforceCertificateDenyList(clientCerts, sysConfig, config, conn, &logEntry)
+		if logEntry.Status != 0 {
+			return
+		}
+		mollyUser := handleCertificateZones(URL, clientCerts, sysConfig, config, conn, &logEntry)
+		if logEntry.Status != 0 {
+			return
+		}
+		if mollyUser != "" {
+			remoteUser = mollyUser
+		}
 		handleRedirects(URL, config, conn, &logEntry)
 		if logEntry.Status != 0 {
 			return
@@ -140,7 +206,7 @@ func handleGeminiRequest(conn net.Conn, sysConfig SysConfig, config UserConfig,
 	// Check whether this URL is in a configured CGI path
 	for _, cgiPath := range sysConfig.CGIPaths {
 		if strings.HasPrefix(path, cgiPath) {
-			handleCGI(sysConfig, path, cgiPath, URL, &logEntry, conn)
+			handleCGI(sysConfig, path, cgiPath, URL, nil, remoteUser, &logEntry, conn)
 			if logEntry.Status != 0 {
 				return
 			}
@@ -150,7 +216,23 @@ func handleGeminiRequest(conn net.Conn, sysConfig SysConfig, config UserConfig,
 	// Check whether this URL is mapped to an SCGI app
 	for scgiPath, scgiSocket := range sysConfig.SCGIPaths {
 		if strings.HasPrefix(URL.Path, scgiPath) {
-			handleSCGI(URL, scgiPath, scgiSocket, sysConfig, &logEntry, conn)
+			handleSCGI(URL, scgiPath, scgiSocket, sysConfig, remoteUser, &logEntry, conn)
+			return
+		}
+	}
+
+	// Check whether this URL is mapped to a FastCGI app
+	for fcgiPath, fcgiAddress := range sysConfig.FastCGIPaths {
+		if strings.HasPrefix(URL.Path, fcgiPath) {
+			handleFastCGI(URL, fcgiPath, fcgiAddress, sysConfig, remoteUser, &logEntry, conn)
+			return
+		}
+	}
+
+	// Check whether this URL is mapped to an upstream Gemini server
+	for proxyPath, upstream := range sysConfig.ProxyPaths {
+		if strings.HasPrefix(URL.Path, proxyPath) {
+			handleProxy(URL, proxyPath, upstream, sysConfig, &logEntry, conn)
 			return
 		}
 	}
@@ -166,8 +248,8 @@ func handleGeminiRequest(conn net.Conn, sysConfig SysConfig, config UserConfig,
 		info, err = os.Stat(path)
 		if os.IsNotExist(err) || os.IsPermission(err) {
 			if !strings.HasSuffix(path, ".gmi") {
-				path = Sprintf("%s.gmi", path);
-				break
+				path = fmt.Sprintf("%s.gmi", path)
+				continue
 			} else {
 				conn.Write([]byte("51 Not found!\r\n"))
 				logEntry.Status = 51
@@ -227,14 +309,13 @@ func handleGeminiRequest(conn net.Conn, sysConfig SysConfig, config UserConfig,
 	}
 }
 
-func readRequest(conn net.Conn, logEntry *LogEntry) (*url.URL, error) {
+func readRequest(conn net.Conn, reader *bufio.Reader, logEntry *LogEntry) (*url.URL, error) {
 	err := conn.SetReadDeadline(time.Now().Add(30 * time.Second))
 	if err != nil {
 		log.Println("Error setting read deadline: " + err.Error())
 		return nil, err
 	}
 
-	reader := bufio.NewReaderSize(conn, 1024)
 	request, overflow, err := reader.ReadLine()
 
 	if overflow {
@@ -284,6 +365,30 @@ func resolvePath(path string, config SysConfig) string {
 	return path
 }
 
+func selectVirtualHost(hostname string, sysConfig SysConfig, config UserConfig) (SysConfig, UserConfig, bool) {
+	if hostname == sysConfig.Hostname {
+		return sysConfig, config, true
+	}
+	for _, vhost := range sysConfig.VirtualHosts {
+		for _, vhostname := range vhost.Hostnames {
+			if hostname != vhostname {
+				continue
+			}
+			sysConfig.Hostname = hostname
+			sysConfig.CertPath = vhost.CertPath
+			sysConfig.KeyPath = vhost.KeyPath
+			sysConfig.DocBase = vhost.DocBase
+			sysConfig.HomeDocBase = vhost.HomeDocBase
+			sysConfig.CGIPaths = vhost.CGIPaths
+			sysConfig.SCGIPaths = vhost.SCGIPaths
+			sysConfig.FastCGIPaths = vhost.FastCGIPaths
+			sysConfig.ProxyPaths = vhost.ProxyPaths
+			return sysConfig, vhost.UserConfig, true
+		}
+	}
+	return sysConfig, config, false
+}
+
 func handleRedirects(URL *url.URL, config UserConfig, conn net.Conn, logEntry *LogEntry) {
 	handleRedirectsInner(URL, config.TempRedirects, 30, conn, logEntry)
 	handleRedirectsInner(URL, config.PermRedirects, 31, conn, logEntry)
@@ -419,18 +524,24 @@ func serveFile(path string, info os.FileInfo, logEntry *LogEntry, conn net.Conn,
 		// knows something has gone wrong!
 		tlsConn, _ := conn.(*tls.Conn)
 		netConn := tlsConn.NetConn()
-		tcpConn := netConn.(*net.TCPConn)
 		remoteAddr := conn.RemoteAddr().String()
 		if errors.Is(err, os.ErrDeadlineExceeded) {
 			log.Println("Writing to " + remoteAddr + " timed out.")
 			// Make sure Close() below takes immediate effect in
 			// the case of a timeout as a defence against
 			// socket exhaustion attacks
-			tcpConn.SetLinger(0)
+			rawConn := netConn
+			if proxied, ok := rawConn.(*proxyProtocolConn); ok {
+				rawConn = proxied.NetConn()
+			}
+			tcpConn, ok := rawConn.(*net.TCPConn)
+			if ok {
+				tcpConn.SetLinger(0)
+			}
 		} else {
 			log.Println("Error writing response to " + remoteAddr + ": " + err.Error())
 		}
-		tcpConn.Close()
+		netConn.Close()
 		return
 	}
 	logEntry.Status = 20
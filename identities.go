@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNameTaken = errors.New("Name already taken")
+var errAlreadyRegistered = errors.New("Certificate already registered")
+
+type Identity struct {
+	Name        string
+	Fingerprint string
+}
+
+// A named group of identities, defined either in the config file or in a
+// file of its own which is re-read whenever it changes.
+type identityGroup struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	members []Identity
+}
+
+// Build the groups defined by the Groups and GroupFiles sections of config,
+// reading each group file for the first time.
+func loadIdentityGroups(config SysConfig) (map[string]*identityGroup, error) {
+	groups := make(map[string]*identityGroup)
+	for name, members := range config.Groups {
+		group := new(identityGroup)
+		for _, member := range members {
+			fingerprint, present := config.Identities[member]
+			if !present {
+				return groups, errors.New("Unknown identity " + member + " in group " + name)
+			}
+			group.members = append(group.members, Identity{member, fingerprint})
+		}
+		groups[name] = group
+	}
+	for name, path := range config.GroupFiles {
+		if groups[name] != nil {
+			return groups, errors.New("Group " + name + " defined in both Groups and GroupFiles")
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return groups, err
+		}
+		members, err := readIdentityFile(path)
+		if err != nil {
+			return groups, errors.New("Error reading group file " + path + ": " + err.Error())
+		}
+		groups[name] = &identityGroup{path: path, modTime: info.ModTime(), members: members}
+	}
+	return groups, nil
+}
+
+// Return the members of the group, first re-reading its file if it has
+// been modified since it was last read.  If the file can't be read, the
+// previous members are kept.
+func (group *identityGroup) getMembers() []Identity {
+	if group.path == "" {
+		return group.members
+	}
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	group.refresh()
+	return group.members
+}
+
+// Re-read the group's file if it has been modified.  The caller must hold
+// group.mu.
+func (group *identityGroup) refresh() {
+	info, err := os.Stat(group.path)
+	if err != nil || info.ModTime().Equal(group.modTime) {
+		return
+	}
+	group.modTime = info.ModTime()
+	members, err := readIdentityFile(group.path)
+	if err != nil {
+		log.Println("Error re-reading group file " + group.path + ", keeping previous members: " + err.Error())
+		return
+	}
+	group.members = members
+}
+
+// Add an identity for clientCert to the group and append it to the group's
+// file, unless clientCert is already a member or the name is already used
+// by another member.  Both are checked while holding the lock, so that
+// simultaneous requests can't register the same certificate twice.
+func (group *identityGroup) register(identity Identity, clientCert *x509.Certificate, defaultType string) error {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	group.refresh()
+	for _, member := range group.members {
+		if certificateMatches(clientCert, []string{member.Fingerprint}, defaultType) {
+			return errAlreadyRegistered
+		}
+	}
+	for _, member := range group.members {
+		if member.Name == identity.Name {
+			return errNameTaken
+		}
+	}
+	file, err := os.OpenFile(group.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(identity.Name + " " + identity.Fingerprint + "\n")
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+	group.members = append(group.members, identity)
+	info, err := os.Stat(group.path)
+	if err == nil {
+		group.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Read a group file, which contains one fingerprint per line, optionally
+// preceded by the name of the identity it belongs to.  Blank lines and
+// lines beginning with # are ignored.
+func readIdentityFile(path string) ([]Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var members []Identity
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 1:
+			members = append(members, Identity{"", fields[0]})
+		case 2:
+			members = append(members, Identity{fields[0], fields[1]})
+		default:
+			return nil, errors.New("Malformed line: " + line)
+		}
+	}
+	return members, scanner.Err()
+}
+
+// Report whether clientCert is allowed by one of allowed, each of which is
+// a fingerprint, the name of an identity, or "group:" followed by the name
+// of a group.  The name of the identity matched, if known, is also
+// returned.  Only the client's own certificate should be identified, not
+// the rest of the chain it sent, as the handshake doesn't prove that the
+// client holds the keys of those.
+func identifyCertificate(clientCert *x509.Certificate, allowed []string, config SysConfig) (bool, string) {
+	for _, entry := range allowed {
+		if strings.HasPrefix(entry, "group:") {
+			group, present := config.IdentityGroups[entry[len("group:"):]]
+			if !present {
+				log.Println("Ignoring unknown group " + entry[len("group:"):] + " in zone")
+				continue
+			}
+			for _, identity := range group.getMembers() {
+				if certificateMatches(clientCert, []string{identity.Fingerprint}, config.FingerprintType) {
+					return true, identity.Name
+				}
+			}
+		} else if fingerprint, present := config.Identities[entry]; present {
+			if certificateMatches(clientCert, []string{fingerprint}, config.FingerprintType) {
+				return true, entry
+			}
+		} else if certificateMatches(clientCert, []string{entry}, config.FingerprintType) {
+			return true, ""
+		}
+	}
+	return false, ""
+}
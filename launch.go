@@ -2,14 +2,13 @@ package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
-	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -43,70 +42,36 @@ func launch(sysConfig SysConfig, userConfig UserConfig, privInfo userInfo) int {
 		defer accessLogFile.Close()
 	}
 
-	// Read TLS files, create TLS config
-	// Check key file permissions first
-	info, err := os.Stat(sysConfig.KeyPath)
-	if err != nil {
-		log.Println("Error opening TLS key file: " + err.Error())
-		return 1
-	}
-	if uint64(info.Mode().Perm())&0444 == 0444 {
-		log.Println("Refusing to use world-readable TLS key file " + sysConfig.KeyPath)
-		return 1
-	}
-	// Check certificate hostname matches server hostname
-	info, err = os.Stat(sysConfig.CertPath)
-	if err != nil {
-		log.Println("Error opening TLS certificate file: " + err.Error())
-		return 1
-	}
-	certFile, err := os.Open(sysConfig.CertPath)
-	if err != nil {
-		log.Println("Error opening TLS certificate file: " + err.Error())
-		return 1
-	}
-	certBytes, err := ioutil.ReadAll(certFile)
-	if err != nil {
-		log.Println("Error reading TLS certificate file: " + err.Error())
-		return 1
-	}
-	certDer, _ := pem.Decode(certBytes)
-	if certDer == nil {
-		log.Println("Error decoding TLS certificate file: " + err.Error())
-		return 1
-	}
-	certx509, err := x509.ParseCertificate(certDer.Bytes)
-	if err != nil {
-		log.Println("Error parsing TLS certificate: " + err.Error())
-		return 1
+	// Generate missing TLS files, if asked
+	if sysConfig.AutoCertificate {
+		err = generateCertificates(sysConfig)
+		if err != nil {
+			return 1
+		}
 	}
-	err = certx509.VerifyHostname(sysConfig.Hostname)
+
+	// Read TLS files, create TLS config
+	initialConfig, err := newRunningConfig(sysConfig, userConfig)
 	if err != nil {
-		log.Println("Invalid TLS certificate: " + err.Error())
 		return 1
 	}
-	// Warn if certificate is expired
-	now := time.Now()
-	if now.After(certx509.NotAfter) {
-		log.Println("Hey, your certificate expired on " + certx509.NotAfter.String() + "!!!")
-	}
+	var current atomic.Value
+	current.Store(initialConfig)
 
-	// Load certificate and private key
-	cert, err := tls.LoadX509KeyPair(sysConfig.CertPath, sysConfig.KeyPath)
-	if err != nil {
-		log.Println("Error loading TLS keypair: " + err.Error())
-		return 1
+	// Warn about, or renew, certificates which are close to expiry.  This
+	// is done now, while we can probably still save renewed certificates,
+	// and later by the reload routine below.
+	monitor := newCertMonitor()
+	checkCertificates := func() {
+		renewed := monitor.check(current.Load().(*runningConfig))
+		if renewed != nil {
+			current.Store(renewed)
+		}
 	}
+	checkCertificates()
 	var tlscfg tls.Config
-	tlscfg.Certificates = []tls.Certificate{cert}
-	tlscfg.ClientAuth = tls.RequestClientCert
-	if sysConfig.AllowTLS12 {
-		tlscfg.MinVersion = tls.VersionTLS12
-	} else {
-		tlscfg.MinVersion = tls.VersionTLS13
-	}
-	if len(userConfig.CertificateZones) > 0 || sysConfig.ReadMollyFiles {
-		tlscfg.ClientAuth = tls.RequestClientCert
+	tlscfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return current.Load().(*runningConfig).tlsConfig, nil
 	}
 
 	// Try to chdir to /, so we don't block any mountpoints
@@ -116,20 +81,28 @@ func launch(sysConfig SysConfig, userConfig UserConfig, privInfo userInfo) int {
                 log.Println("Could not change working directory to /: " + err.Error())
         }
 
-	// Apply security restrictions
-	err = enableSecurityRestrictions(sysConfig, privInfo)
+	// Create TLS listeners
+	rawListeners, err := getListeners(sysConfig)
 	if err != nil {
-		log.Println("Exiting due to failure to apply security restrictions.")
+		log.Println("Error creating TLS listener: " + err.Error())
 		return 1
 	}
+	listeners := make([]net.Listener, len(rawListeners))
+	for i, rawListener := range rawListeners {
+		defer rawListener.Close()
+		listeners[i], err = wrapListener(rawListener, sysConfig, &tlscfg)
+		if err != nil {
+			log.Println("Error creating TLS listener: " + err.Error())
+			return 1
+		}
+	}
 
-	// Create TLS listener
-	listener, err := tls.Listen("tcp", ":"+strconv.Itoa(sysConfig.Port), &tlscfg)
+	// Apply security restrictions
+	err = enableSecurityRestrictions(sysConfig, privInfo)
 	if err != nil {
-		log.Println("Error creating TLS listener: " + err.Error())
+		log.Println("Exiting due to failure to apply security restrictions.")
 		return 1
 	}
-	defer listener.Close()
 
 	// Start log handling routines
 	var accessLogEntries chan LogEntry
@@ -147,39 +120,182 @@ func launch(sysConfig SysConfig, userConfig UserConfig, privInfo userInfo) int {
 		}()
 	}
 
-	// Start listening for signals
+	// Start listening for signals.  A second signal means we should stop
+	// waiting for handlers and exit immediately.
 	shutdown := make(chan struct{})
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGTERM)
+	var stopping sync.Once
+	stopAccepting := func() {
+		stopping.Do(func() {
+			close(shutdown)
+			for _, listener := range listeners {
+				listener.Close()
+			}
+		})
+	}
+	sigterm := make(chan os.Signal, 2)
+	signal.Notify(sigterm, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigterm
+		log.Println("Caught " + signalName(sig) + ".  Waiting for handlers to finish...")
+		stopAccepting()
+		sig = <-sigterm
+		log.Println("Caught " + signalName(sig) + " again.  Exiting immediately.")
+		os.Exit(1)
+	}()
+
+	// Hand our listeners over to a new process on SIGUSR2, and stop
+	// accepting connections once it's ready
+	upgrade := make(chan os.Signal, 1)
+	notifyUpgradeSignal(upgrade)
+	go func() {
+		for {
+			<-upgrade
+			if !sysConfig.AllowUpgrade {
+				log.Println("Caught SIGUSR2, but ignoring it as AllowUpgrade is not set.")
+				continue
+			}
+			log.Println("Caught SIGUSR2.  Starting new process...")
+			err := startUpgrade(rawListeners, sysConfig.WorkingDir)
+			if err != nil {
+				log.Println("Upgrade failed, continuing to serve: " + err.Error())
+				continue
+			}
+			log.Println("New process is ready.  Waiting for handlers to finish...")
+			stopAccepting()
+			return
+		}
+	}()
+
+	// Reload configuration on SIGHUP, and check certificates after each
+	// reload and periodically
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
 	go func() {
-		<-sigterm
-		log.Println("Caught SIGTERM.  Waiting for handlers to finish...")
-		close(shutdown)
-		listener.Close()
+		ticker := time.NewTicker(certificateCheckInterval)
+		for {
+			select {
+			case <-sighup:
+				log.Println("Caught SIGHUP.  Reloading configuration...")
+				newConfig, err := reloadConfig(current.Load().(*runningConfig))
+				if err != nil {
+					log.Println("Keeping previous configuration due to failed reload.")
+					continue
+				}
+				current.Store(newConfig)
+				log.Println("Configuration reloaded.")
+			case <-ticker.C:
+			}
+			checkCertificates()
+		}
 	}()
 
-	// Infinite serve loop (SIGTERM breaks out)
-	running := true
+	// Infinite serve loop for each listener (SIGTERM or an upgrade breaks
+	// out)
 	var wg sync.WaitGroup
+	var accepting sync.WaitGroup
+	active := newConnTracker()
 	rl := newRateLimiter(sysConfig.RateLimitAverage, sysConfig.RateLimitSoft, sysConfig.RateLimitHard)
-	for running {
-		conn, err := listener.Accept()
-		if err == nil {
-			wg.Add(1)
-			go handleGeminiRequest(conn, sysConfig, userConfig, accessLogEntries, &rl, &wg)
-		} else {
-			select {
-			case <-shutdown:
-				running = false
-			default:
-				log.Println("Error accepting connection: " + err.Error())
+	for _, listener := range listeners {
+		accepting.Add(1)
+		go func(listener net.Listener) {
+			defer accepting.Done()
+			for {
+				conn, err := listener.Accept()
+				if err == nil {
+					wg.Add(1)
+					active.add(conn)
+					config := current.Load().(*runningConfig)
+					go func() {
+						handleGeminiRequest(conn, config.sysConfig, config.userConfig, accessLogEntries, rl, &wg)
+						active.remove(conn)
+					}()
+				} else {
+					select {
+					case <-shutdown:
+						return
+					default:
+						log.Println("Error accepting connection: " + err.Error())
+					}
+				}
 			}
+		}(listener)
+	}
+	// Let the process which started us for an upgrade know we're ready
+	signalReady()
+	accepting.Wait()
+	// Wait for still-running handler Go routines to finish, for at most
+	// ShutdownTimeout seconds
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	var timeout <-chan time.Time
+	shutdownTimeout := current.Load().(*runningConfig).sysConfig.ShutdownTimeout
+	if shutdownTimeout > 0 {
+		timeout = time.After(time.Duration(shutdownTimeout) * time.Second)
+	}
+	select {
+	case <-finished:
+	case <-timeout:
+		// Cut off remaining clients and kill any CGI processes, then give
+		// their handlers a moment to notice
+		cut := active.closeAll()
+		cancelCGIProcesses()
+		log.Println("Shutdown timeout expired, closed " + strconv.Itoa(cut) + " remaining connections.")
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
 		}
 	}
-	// Wait for still-running handler Go routines to finish
-	wg.Wait()
 	log.Println("Exiting.")
 
 	// Exit successfully
 	return 0
 }
+
+// The connections currently being handled, so they can be closed if they
+// take too long to finish at shutdown.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]bool)}
+}
+
+func (ct *connTracker) add(conn net.Conn) {
+	ct.mu.Lock()
+	ct.conns[conn] = true
+	ct.mu.Unlock()
+}
+
+func (ct *connTracker) remove(conn net.Conn) {
+	ct.mu.Lock()
+	delete(ct.conns, conn)
+	ct.mu.Unlock()
+}
+
+// Close every connection, returning how many there were.  The underlying
+// connections of TLS connections are closed directly, as sending a close
+// notification to a stuck client could itself block.
+func (ct *connTracker) closeAll() int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for conn := range ct.conns {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			tlsConn.NetConn().Close()
+		} else {
+			conn.Close()
+		}
+	}
+	return len(ct.conns)
+}
+
+func signalName(sig os.Signal) string {
+	if sig == os.Interrupt {
+		return "SIGINT"
+	}
+	return "SIGTERM"
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor passed by systemd socket activation, see
+// sd_listen_fds(3).
+const listenFDsStart = 3
+
+// Find the file descriptors of any listening sockets we have inherited,
+// either from a previous molly brown process handing them over during an
+// upgrade, specified by ListenFD or passed to us by systemd.
+func inheritedListenerFDs(config SysConfig) []int {
+	count, err := strconv.Atoi(os.Getenv("MOLLY_LISTEN_FDS"))
+	if err == nil && count > 0 {
+		return listenFDs(count)
+	}
+	if config.ListenFD > 0 {
+		return []int{config.ListenFD}
+	}
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil
+	}
+	return listenFDs(count)
+}
+
+func listenFDs(count int) []int {
+	fds := make([]int, count)
+	for i := range fds {
+		fds[i] = listenFDsStart + i
+	}
+	return fds
+}
+
+// Create the listeners to accept connections on.  Inherited sockets are
+// used if there are any, otherwise we listen on each of the Listen
+// addresses, or on Port if there are none.
+func getListeners(config SysConfig) ([]net.Listener, error) {
+	fds := inheritedListenerFDs(config)
+
+	// The socket activation variables are only meant for us
+	os.Unsetenv("MOLLY_LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	if len(fds) > 0 {
+		for _, fd := range fds {
+			listener, err := inheritListener(fd)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			listeners = append(listeners, listener)
+		}
+		return listeners, nil
+	}
+
+	addresses := config.Listen
+	if len(addresses) == 0 {
+		addresses = []string{":" + strconv.Itoa(config.Port)}
+	}
+	for _, address := range addresses {
+		listener, err := listen(address)
+		if err != nil {
+			closeAll()
+			return nil, errors.New("Could not listen on " + address + ": " + err.Error())
+		}
+		log.Println("Listening on " + address + ".")
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Wrap a listener so that it reads PROXY protocol headers from trusted
+// sources, if configured, and uses TLS.
+func wrapListener(listener net.Listener, config SysConfig, tlscfg *tls.Config) (net.Listener, error) {
+	if len(config.ProxyProtocolSources) > 0 {
+		ppl, err := newProxyProtocolListener(listener, config.ProxyProtocolSources)
+		if err != nil {
+			return listener, err
+		}
+		listener = ppl
+	}
+	return tls.NewListener(listener, tlscfg), nil
+}
+
+// Use the listening socket with file descriptor fd.
+func inheritListener(fd int) (net.Listener, error) {
+	// net.FileListener works on a duplicate of the file descriptor, so the
+	// original can be closed either way
+	file := os.NewFile(uintptr(fd), "inherited socket")
+	if file == nil {
+		return nil, errors.New("Invalid inherited socket " + strconv.Itoa(fd))
+	}
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return nil, errors.New("Could not use inherited socket " + strconv.Itoa(fd) + ": " + err.Error())
+	}
+	log.Println("Using inherited socket " + strconv.Itoa(fd) + " listening on " + listener.Addr().String() + ".")
+	return listener, nil
+}
+
+// Listen on a single address from the Listen option.  Addresses starting
+// with "unix:" are paths of unix domain sockets, and anything else is a TCP
+// address.  IP addresses are only listened on using the corresponding IP
+// version, so "[::]:1965" does not accept IPv4 connections.
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(address, "unix:")
+		// Remove any socket left behind by a previous run, which might
+		// not have been able to remove it after dropping privileges
+		info, err := os.Lstat(path)
+		if err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	network := "tcp"
+	ip := net.ParseIP(host)
+	if ip != nil && ip.To4() != nil {
+		network = "tcp4"
+	} else if ip != nil {
+		network = "tcp6"
+	}
+	return net.Listen(network, address)
+}
+
+// Return a client's address without the port (keeping the brackets around
+// IPv6 addresses), or an empty string for clients without an IP address,
+// e.g. those connected over a unix domain socket.
+func remoteHost(addr net.Addr) string {
+	host := addr.String()
+	index := strings.LastIndex(host, ":")
+	if index < 0 {
+		return ""
+	}
+	return host[0:index]
+}
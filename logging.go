@@ -4,7 +4,6 @@ import (
 	"net"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -19,8 +18,10 @@ func writeLogEntry(fp *os.File, entry LogEntry) {
 	var line string
 	line = entry.Time.Format(time.RFC3339)
 	// Trim port from remote address
-	addr := entry.RemoteAddr.String()
-	addr = addr[0:strings.LastIndex(addr, ":")]
+	addr := remoteHost(entry.RemoteAddr)
+	if addr == "" {
+		addr = "-"
+	}
 	line += "\t" + addr
 	line += "\t" + strconv.Itoa(entry.Status)
 	line += "\t" + entry.RequestURL
@@ -1,3 +1,4 @@
+//go:build js || nacl || plan9 || windows
 // +build js nacl plan9 windows
 
 package main
@@ -12,10 +13,12 @@ import (
 func main() {
 	var conf_file string
 	var version bool
+	var gencert bool
 
 	// Parse args
 	flag.StringVar(&conf_file, "c", "/etc/molly.conf", "Path to config file")
 	flag.BoolVar(&version, "v", false, "Print version and exit")
+	flag.BoolVar(&gencert, "gencert", false, "Generate missing TLS certificates and exit")
 	flag.Parse()
 
 	// If requested, print version and exit
@@ -30,6 +33,15 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// If requested, generate certificates and exit
+	if gencert {
+		err = generateCertificates(sysConfig)
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Run server and exit
 	var dummy userInfo
 	os.Exit(launch(sysConfig, userConfig, dummy))
@@ -1,3 +1,4 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
 // +build aix darwin dragonfly freebsd illumos linux netbsd openbsd solaris
 
 package main
@@ -15,12 +16,20 @@ func main() {
 	var chroot string
 	var user string
 	var version bool
+	var gencert bool
+
+	// If we were started as the CGI helper or to apply resource limits
+	// to a CGI process, be that instead
+	runCGIWrapperIfRequested()
+	runCGIHelperIfRequested()
+	findExecutable()
 
 	// Parse args
 	flag.StringVar(&conf_file, "c", "/etc/molly.conf", "Path to config file")
 	flag.StringVar(&chroot, "C", "", "Path to chroot into")
 	flag.StringVar(&user, "u", "nobody", "Unprivileged user")
 	flag.BoolVar(&version, "v", false, "Print version and exit")
+	flag.BoolVar(&gencert, "gencert", false, "Generate missing TLS certificates and exit")
 	flag.Parse()
 
 	// If requested, print version and exit
@@ -35,9 +44,32 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// The resource limiting wrapper refuses to run setuid or setgid, so
+	// fail now rather than on every CGI request
+	if getCGILimits(sysConfig) != (CGILimits{}) && (os.Getuid() != os.Geteuid() || os.Getgid() != os.Getegid()) {
+		log.Fatal("CGI resource limits can't be used when molly brown is run as a setuid or setgid executable")
+	}
+
 	// Read user info
 	privInfo, err := getUserInfo(user)
 
+	// Make sure any inherited listening sockets, or the pipe to signal an
+	// upgrade is ready, aren't passed on to the CGI helper or CGI processes
+	for _, fd := range inheritedListenerFDs(sysConfig) {
+		syscall.CloseOnExec(fd)
+	}
+	if fd := upgradeReadyFD(); fd >= 0 {
+		syscall.CloseOnExec(fd)
+	}
+
+	// Start the CGI helper, if needed, while we're still root
+	if !gencert {
+		err = startCGIHelper(sysConfig, chroot)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Chroot, if asked
 	if chroot != "" {
 		err := syscall.Chroot(chroot)
@@ -50,6 +82,15 @@ func main() {
 		}
 	}
 
+	// If requested, generate certificates (within the chroot) and exit
+	if gencert {
+		err = generateCertificates(sysConfig)
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Run server and exit
 	os.Exit(launch(sysConfig, userConfig, privInfo))
 }
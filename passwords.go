@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A client certificate which has been authorised by entering a password.
+type passwordSession struct {
+	name    string
+	expires time.Time
+}
+
+// The sessions for each password file and certificate fingerprint.  These
+// are kept across reloads, but not restarts.
+type passwordSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]passwordSession
+}
+
+var passwordSessions = &passwordSessionStore{sessions: make(map[string]passwordSession)}
+
+func (store *passwordSessionStore) get(passwordFile string, fingerprint string) (passwordSession, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	key := passwordFile + "\x00" + fingerprint
+	session, present := store.sessions[key]
+	if present && !session.expires.IsZero() && time.Now().After(session.expires) {
+		delete(store.sessions, key)
+		return session, false
+	}
+	return session, present
+}
+
+// Start a session lasting for lifetime seconds, or until restart if
+// lifetime is zero, and forget any sessions which have expired.
+func (store *passwordSessionStore) add(passwordFile string, fingerprint string, name string, lifetime int) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	for key, session := range store.sessions {
+		if !session.expires.IsZero() && now.After(session.expires) {
+			delete(store.sessions, key)
+		}
+	}
+	session := passwordSession{name: name}
+	if lifetime > 0 {
+		session.expires = now.Add(time.Duration(lifetime) * time.Second)
+	}
+	store.sessions[passwordFile+"\x00"+fingerprint] = session
+}
+
+// Password zones require a client certificate, and a password to be
+// entered once for each certificate.  The name the password belongs to, if
+// any, is returned.
+func handlePasswordZones(URL *url.URL, clientCerts []*x509.Certificate, config SysConfig, conn net.Conn, logEntry *LogEntry) string {
+	remoteUser := ""
+	for zone, passwordZone := range config.PasswordZones {
+		matched, err := regexp.MatchString(zone, URL.Path)
+		if !matched || err != nil {
+			continue
+		}
+		if len(clientCerts) == 0 {
+			conn.Write([]byte("60 A certificate is required to access this resource\r\n"))
+			logEntry.Status = 60
+			return ""
+		}
+		fingerprint := getCertFingerprint(clientCerts[0])
+		session, present := passwordSessions.get(passwordZone.PasswordFile, fingerprint)
+		if present {
+			if session.name != "" {
+				remoteUser = session.name
+			}
+			continue
+		}
+
+		// Check the password given as the query, making sure it doesn't
+		// end up in the access log
+		if URL.RawQuery == "" {
+			conn.Write([]byte("11 " + passwordZone.Prompt + "\r\n"))
+			logEntry.Status = 11
+			return ""
+		}
+		password, err := url.QueryUnescape(URL.RawQuery)
+		URL.RawQuery = ""
+		logEntry.RequestURL = URL.String()
+		var name string
+		if err == nil {
+			matched, name, err = checkPassword(passwordZone.PasswordFile, password)
+		}
+		if err != nil {
+			log.Println("Error checking password against password file " + passwordZone.PasswordFile + ": " + err.Error())
+			conn.Write([]byte("40 Error checking password!\r\n"))
+			logEntry.Status = 40
+			return ""
+		} else if !matched {
+			conn.Write([]byte("11 Wrong password, please try again\r\n"))
+			logEntry.Status = 11
+			return ""
+		}
+		passwordSessions.add(passwordZone.PasswordFile, fingerprint, name, config.PasswordSessionTime)
+
+		// Send the client back to where they were going
+		conn.Write([]byte("30 " + URL.String() + "\r\n"))
+		logEntry.Status = 30
+		return ""
+	}
+	return remoteUser
+}
+
+// Report whether password matches any of the hashes in passwordFile, and
+// return the name which the matching hash belongs to, if any.
+func checkPassword(passwordFile string, password string) (bool, string, error) {
+	entries, err := readPasswordFile(passwordFile)
+	if err != nil {
+		return false, "", err
+	}
+	for _, entry := range entries {
+		matched, err := passwordMatches(entry.hash, password)
+		if err != nil {
+			return false, "", err
+		}
+		if matched {
+			return true, entry.name, nil
+		}
+	}
+	return false, "", nil
+}
+
+type passwordEntry struct {
+	name string
+	hash string
+}
+
+// Read a password file, which contains one bcrypt or Argon2 hash per line,
+// optionally preceded by a name and a colon as in htpasswd files.  Blank
+// lines and lines beginning with # are ignored.
+func readPasswordFile(path string) ([]passwordEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []passwordEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var entry passwordEntry
+		entry.hash = line
+		colon := strings.Index(line, ":")
+		if colon != -1 {
+			entry.name, entry.hash = line[:colon], line[colon+1:]
+		}
+		if !strings.HasPrefix(entry.hash, "$2") && !strings.HasPrefix(entry.hash, "$argon2") {
+			return nil, errors.New("Unsupported password hash on line: " + line)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func passwordMatches(hash string, password string) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2") {
+		return argon2Matches(hash, password)
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Check password against an Argon2 hash in the usual encoding, e.g.
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>, with the salt and hash in
+// unpadded base64.
+func argon2Matches(hash string, password string) (bool, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[2] != "v=19" {
+		return false, errors.New("Unsupported Argon2 hash " + hash)
+	}
+	var memory, passes, threads uint64
+	for _, param := range strings.Split(fields[3], ",") {
+		keyValue := strings.SplitN(param, "=", 2)
+		if len(keyValue) != 2 {
+			return false, errors.New("Malformed Argon2 parameters " + fields[3])
+		}
+		value, err := strconv.ParseUint(keyValue[1], 10, 32)
+		if err != nil {
+			return false, errors.New("Malformed Argon2 parameters " + fields[3])
+		}
+		switch keyValue[0] {
+		case "m":
+			memory = value
+		case "t":
+			passes = value
+		case "p":
+			threads = value
+		}
+	}
+	if memory == 0 || passes == 0 || threads == 0 || threads > 255 {
+		return false, errors.New("Malformed Argon2 parameters " + fields[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return false, err
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil {
+		return false, err
+	} else if len(expected) == 0 {
+		return false, errors.New("Unsupported Argon2 hash " + hash)
+	}
+	var actual []byte
+	switch fields[1] {
+	case "argon2id":
+		actual = argon2.IDKey([]byte(password), salt, uint32(passes), uint32(memory), uint8(threads), uint32(len(expected)))
+	case "argon2i":
+		actual = argon2.Key([]byte(password), salt, uint32(passes), uint32(memory), uint8(threads), uint32(len(expected)))
+	default:
+		return false, errors.New("Unsupported Argon2 variant " + fields[1])
+	}
+	return subtle.ConstantTimeCompare(actual, expected) == 1, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/base64"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Encode an Argon2 hash of password in the usual format, using cheap
+// parameters to keep the tests fast.
+func argon2Hash(variant string, password string) string {
+	salt := []byte("saltsaltsaltsalt")
+	var key []byte
+	if variant == "argon2id" {
+		key = argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	} else {
+		key = argon2.Key([]byte(password), salt, 1, 64, 1, 32)
+	}
+	return "$" + variant + "$v=19$m=64,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+}
+
+func TestPasswordMatches(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2id := argon2Hash("argon2id", "secret")
+	argon2i := argon2Hash("argon2i", "secret")
+	salt := base64.RawStdEncoding.EncodeToString([]byte("saltsaltsaltsalt"))
+	key := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		matches  bool
+		invalid  bool
+	}{
+		{"bcrypt right password", string(bcryptHash), "secret", true, false},
+		{"bcrypt wrong password", string(bcryptHash), "Secret", false, false},
+		{"bcrypt empty password", string(bcryptHash), "", false, false},
+		{"bcrypt malformed", "$2a$04$tooshort", "secret", false, true},
+		{"argon2id right password", argon2id, "secret", true, false},
+		{"argon2id wrong password", argon2id, "secret ", false, false},
+		{"argon2i right password", argon2i, "secret", true, false},
+		{"argon2i wrong password", argon2i, "", false, false},
+		{"argon2 variants differ", "$argon2i" + argon2id[len("$argon2id"):], "secret", false, false},
+		{"argon2 missing field", "$argon2id$v=19$m=64,t=1,p=1$" + salt, "secret", false, true},
+		{"argon2 old version", "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key, "secret", false, true},
+		{"argon2 missing version", "$argon2id$m=64,t=1,p=1$" + salt + "$" + key, "secret", false, true},
+		{"argon2 malformed parameter", "$argon2id$v=19$m=64,t,p=1$" + salt + "$" + key, "secret", false, true},
+		{"argon2 non-numeric parameter", "$argon2id$v=19$m=lots,t=1,p=1$" + salt + "$" + key, "secret", false, true},
+		{"argon2 missing memory", "$argon2id$v=19$t=1,p=1$" + salt + "$" + key, "secret", false, true},
+		{"argon2 zero passes", "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key, "secret", false, true},
+		{"argon2 zero threads", "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key, "secret", false, true},
+		{"argon2 too many threads", "$argon2id$v=19$m=64,t=1,p=256$" + salt + "$" + key, "secret", false, true},
+		{"argon2 bad salt", "$argon2id$v=19$m=64,t=1,p=1$!!!!$" + key, "secret", false, true},
+		{"argon2 bad hash", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$!!!!", "secret", false, true},
+		{"argon2 empty hash", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$", "secret", false, true},
+		{"argon2 unknown variant", "$argon2d$v=19$m=64,t=1,p=1$" + salt + "$" + key, "secret", false, true},
+	}
+	for _, test := range tests {
+		matches, err := passwordMatches(test.hash, test.password)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if matches != test.matches {
+			t.Errorf("%s: expected match %v, got %v", test.name, test.matches, matches)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "molly-brown-passwords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aliceHash, err := bcrypt.GenerateFromPassword([]byte("alice's password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := "# Members\n\n" +
+		"alice:" + string(aliceHash) + "\n" +
+		"  bob:" + argon2Hash("argon2id", "bob's password") + "  \n" +
+		argon2Hash("argon2i", "anonymous password") + "\n"
+
+	tests := []struct {
+		name     string
+		contents string
+		password string
+		matches  bool
+		user     string
+		invalid  bool
+	}{
+		{"bcrypt entry", contents, "alice's password", true, "alice", false},
+		{"argon2id entry", contents, "bob's password", true, "bob", false},
+		{"entry without a name", contents, "anonymous password", true, "", false},
+		{"no matching entry", contents, "mallory's password", false, "", false},
+		{"empty file", "", "alice's password", false, "", false},
+		{"only comments", "# alice:" + string(aliceHash) + "\n", "alice's password", false, "", false},
+		{"plain text password", contents + "carol:password\n", "password", false, "", true},
+		{"unsupported hash", "dave:$1$salt$hash\n", "password", false, "", true},
+		{"malformed argon2 hash", "eve:$argon2id$v=19\n", "password", false, "", true},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, "passwords"+string(rune('a'+i)))
+		err := ioutil.WriteFile(path, []byte(test.contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches, user, err := checkPassword(path, test.password)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if matches != test.matches || user != test.user {
+			t.Errorf("%s: expected %v and name %q, got %v and %q", test.name, test.matches, test.user, matches, user)
+		}
+	}
+
+	_, _, err = checkPassword(filepath.Join(dir, "missing"), "password")
+	if err == nil {
+		t.Errorf("missing file: expected an error")
+	}
+}
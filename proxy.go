@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func handleProxy(URL *url.URL, proxyPath string, upstream string, config SysConfig, logEntry *LogEntry, conn net.Conn) {
+	// Rewrite the request to point at the upstream server
+	upstreamBase, err := url.Parse(upstream)
+	if err != nil || upstreamBase.Scheme != "gemini" || upstreamBase.Host == "" {
+		log.Println("Invalid upstream URL " + upstream + " for proxy path " + proxyPath)
+		conn.Write([]byte("43 Proxy misconfigured!\r\n"))
+		logEntry.Status = 43
+		return
+	}
+	if !strings.HasSuffix(upstreamBase.Path, "/") {
+		upstreamBase.Path += "/"
+	}
+	upstreamURL := *upstreamBase
+	upstreamURL.Path += strings.TrimPrefix(URL.Path[len(proxyPath):], "/")
+	upstreamURL.RawQuery = URL.RawQuery
+	upstreamHost := upstreamURL.Host
+	if upstreamURL.Port() == "" {
+		upstreamHost += ":1965"
+	}
+
+	// Connect, checking the upstream certificate against any pinned
+	// fingerprints
+	var tlscfg tls.Config
+	tlscfg.ServerName = upstreamURL.Hostname()
+	tlscfg.InsecureSkipVerify = true
+	tlscfg.MinVersion = tls.VersionTLS12
+	pins := config.ProxyPins[upstreamHost]
+	tlscfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(pins) == 0 {
+			return nil
+		}
+		if len(rawCerts) == 0 {
+			return errors.New("No certificate presented")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if !certificateMatches(cert, pins, "sha256") {
+			return errors.New("Certificate fingerprint " + getCertFingerprint(cert) + " does not match pinned fingerprints")
+		}
+		return nil
+	}
+	clientCert, err := getProxyClientCertificate(conn, config)
+	if err != nil {
+		log.Println("Error deriving proxy client certificate: " + err.Error())
+		conn.Write([]byte("43 Proxy error!\r\n"))
+		logEntry.Status = 43
+		return
+	}
+	if clientCert != nil {
+		tlscfg.Certificates = []tls.Certificate{*clientCert}
+	}
+	socket, err := dialGateway("tcp://"+upstreamHost, config)
+	if err != nil {
+		log.Println("Error connecting to upstream server " + upstreamHost + ": " + err.Error())
+		conn.Write([]byte("43 Error connecting to upstream server!\r\n"))
+		logEntry.Status = 43
+		return
+	}
+	upstreamConn := tls.Client(socket, &tlscfg)
+	defer upstreamConn.Close()
+
+	// Send request
+	_, err = upstreamConn.Write([]byte(upstreamURL.String() + "\r\n"))
+	if err != nil {
+		log.Println("Error sending request to upstream server " + upstreamHost + ": " + err.Error())
+		conn.Write([]byte("43 Error connecting to upstream server!\r\n"))
+		logEntry.Status = 43
+		return
+	}
+
+	// Read and check response header
+	reader := bufio.NewReaderSize(upstreamConn, 1029)
+	header, err := reader.ReadSlice('\n')
+	if len(header) == 0 && err != nil {
+		log.Println("Error reading from upstream server " + upstreamHost + ": " + err.Error())
+		conn.Write([]byte("43 Error reading from upstream server!\r\n"))
+		logEntry.Status = 43
+		return
+	}
+	status, err := parseResponseHeader(header)
+	if err != nil {
+		log.Println("Invalid response header from upstream server " + upstreamHost + ": " + err.Error())
+		conn.Write([]byte("43 Invalid response from upstream server!\r\n"))
+		logEntry.Status = 43
+		return
+	}
+	logEntry.Status = status
+
+	// Make redirects within the upstream server point back through the
+	// proxy
+	if status >= 30 && status < 40 {
+		target := strings.TrimSpace(string(header[2:]))
+		header = []byte(strconv.Itoa(status) + " " + rewriteProxyRedirect(target, &upstreamURL, upstreamBase, URL, proxyPath) + "\r\n")
+	}
+
+	// Relay response, giving up on clients which stop reading just as on
+	// upstream servers which stop sending
+	client := &gatewayConn{conn, time.Duration(config.GatewayReadTimeout) * time.Second}
+	client.Write(header)
+	_, err = io.Copy(client, reader)
+	if err != nil {
+		log.Println("Error relaying response from upstream server " + upstreamHost + ": " + err.Error())
+	}
+}
+
+// Resolve a redirect target sent by the upstream server, and if it lies
+// beneath the upstream base URL, translate it into the corresponding URL
+// beneath proxyPath on this server.
+func rewriteProxyRedirect(target string, upstreamURL *url.URL, upstreamBase *url.URL, URL *url.URL, proxyPath string) string {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	targetURL = upstreamURL.ResolveReference(targetURL)
+	if targetURL.Scheme != upstreamBase.Scheme || targetURL.Host != upstreamBase.Host || !strings.HasPrefix(targetURL.Path, upstreamBase.Path) {
+		return targetURL.String()
+	}
+	rewritten := *URL
+	rewritten.Path = proxyPath
+	if !strings.HasSuffix(rewritten.Path, "/") {
+		rewritten.Path += "/"
+	}
+	rewritten.Path += targetURL.Path[len(upstreamBase.Path):]
+	rewritten.RawPath = ""
+	rewritten.RawQuery = targetURL.RawQuery
+	return rewritten.String()
+}
+
+// Decide which certificate, if any, to present to upstream servers.  With
+// ProxyIdentitySecret set, a client presenting a certificate is represented
+// upstream by a certificate derived from its fingerprint, so upstream
+// servers can tell clients apart even though Gemini has no headers to pass
+// the fingerprint in.  Otherwise the configured proxy certificate, if any,
+// is used for everybody.
+func getProxyClientCertificate(conn net.Conn, config SysConfig) (*tls.Certificate, error) {
+	if config.ProxyIdentitySecret != "" {
+		clientCerts := conn.(*tls.Conn).ConnectionState().PeerCertificates
+		if len(clientCerts) > 0 {
+			return deriveProxyIdentity(getCertFingerprint(clientCerts[0]), config.ProxyIdentitySecret)
+		}
+	}
+	return config.ProxyCertificate, nil
+}
+
+// Derive a certificate from fingerprint.  Both Ed25519 key generation from
+// a seed and Ed25519 signatures are deterministic, so the same client always
+// gets the same certificate (and hence the same fingerprint) upstream.
+func deriveProxyIdentity(fingerprint string, secret string) (*tls.Certificate, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fingerprint))
+	key := ed25519.NewKeyFromSeed(mac.Sum(nil))
+
+	var template x509.Certificate
+	template.SerialNumber = big.NewInt(1)
+	template.Subject = pkix.Name{CommonName: fingerprint[:16]}
+	template.NotBefore = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	template.NotAfter = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(nil, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	var cert tls.Certificate
+	cert.Certificate = [][]byte{der}
+	cert.PrivateKey = key
+	return &cert, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The signature which starts version 2 PROXY protocol headers.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A listener which expects connections from trusted sources, i.e. load
+// balancers, to start with a PROXY protocol header giving the real address
+// of the client.  Connections from other sources are used as they are.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted   []*net.IPNet
+	trustUnix bool
+}
+
+// A connection from a trusted source, whose PROXY protocol header is read
+// the first time its address is needed or it is read from.  This happens
+// in the connection's handler, so that slow clients can't hold up Accept.
+type proxyProtocolConn struct {
+	net.Conn
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func newProxyProtocolListener(listener net.Listener, sources []string) (net.Listener, error) {
+	ppl := proxyProtocolListener{Listener: listener}
+	for _, source := range sources {
+		if source == "unix" {
+			ppl.trustUnix = true
+			continue
+		}
+		if !strings.Contains(source, "/") {
+			if strings.Contains(source, ":") {
+				source += "/128"
+			} else {
+				source += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, errors.New("Invalid ProxyProtocolSources entry " + source + ": " + err.Error())
+		}
+		ppl.trusted = append(ppl.trusted, network)
+	}
+	return &ppl, nil
+}
+
+func (ppl *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := ppl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !ppl.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn}, nil
+}
+
+func (ppl *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		for _, network := range ppl.trusted {
+			if network.Contains(addr.IP) {
+				return true
+			}
+		}
+	case *net.UnixAddr:
+		return ppl.trustUnix
+	}
+	return false
+}
+
+func (conn *proxyProtocolConn) readHeaderOnce() {
+	conn.once.Do(func() {
+		conn.remoteAddr = conn.Conn.RemoteAddr()
+		conn.Conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		addr, err := readProxyProtocolHeader(conn.Conn)
+		conn.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			conn.err = errors.New("Invalid PROXY protocol header: " + err.Error())
+		} else if addr != nil {
+			conn.remoteAddr = addr
+		}
+	})
+}
+
+func (conn *proxyProtocolConn) Read(b []byte) (int, error) {
+	conn.readHeaderOnce()
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn *proxyProtocolConn) RemoteAddr() net.Addr {
+	conn.readHeaderOnce()
+	return conn.remoteAddr
+}
+
+// Return the underlying connection, like tls.Conn's method of the same name.
+func (conn *proxyProtocolConn) NetConn() net.Conn {
+	return conn.Conn
+}
+
+// Read a version 1 or 2 PROXY protocol header, as described at
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt, and return
+// the client address it contains.  The address is nil if the header says
+// the connection was not proxied or its protocol isn't TCP.  Only the
+// header is read, so the rest of the connection can be read normally.
+func readProxyProtocolHeader(reader io.Reader) (net.Addr, error) {
+	start := make([]byte, 6)
+	_, err := io.ReadFull(reader, start)
+	if err != nil {
+		return nil, err
+	}
+	if string(start) == "PROXY " {
+		return readProxyProtocolV1(reader)
+	} else if bytes.Equal(start, proxyProtocolSignature[:6]) {
+		return readProxyProtocolV2(reader)
+	}
+	return nil, errors.New("missing header")
+}
+
+func readProxyProtocolV1(reader io.Reader) (net.Addr, error) {
+	// The header is at most 107 bytes long, including the "PROXY " we have
+	// already read.  Read it a byte at a time so as to not read past it.
+	line := make([]byte, 0, 101)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, errors.New("version 1 header too long")
+		}
+		_, err := io.ReadFull(reader, b)
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, errors.New("malformed version 1 header")
+	}
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.Atoi(fields[3])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("malformed version 1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyProtocolV2(reader io.Reader) (net.Addr, error) {
+	// Read the rest of the signature, the version and command, the address
+	// family and protocol and the length of the addresses
+	header := make([]byte, 10)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:6], proxyProtocolSignature[6:]) {
+		return nil, errors.New("missing header")
+	}
+	if header[6]>>4 != 2 {
+		return nil, errors.New("unsupported version")
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[8:10]))
+	_, err = io.ReadFull(reader, addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connections made by the proxy itself (e.g. health checks) and those
+	// which aren't over TCP keep their own address
+	if header[6]&0x0f == 0 {
+		return nil, nil
+	} else if header[6]&0x0f != 1 {
+		return nil, errors.New("unsupported command")
+	}
+	switch header[7] {
+	case 0x11:
+		if len(addresses) < 12 {
+			return nil, errors.New("malformed version 2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:10]))}, nil
+	case 0x21:
+		if len(addresses) < 36 {
+			return nil, errors.New("malformed version 2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// Build a version 2 PROXY protocol header with the given version and
+// command byte, address family and protocol byte, and address block.
+func proxyProtocolV2Header(versionCommand byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyProtocolSignature...)
+	header = append(header, versionCommand, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	tcp4 := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0xdc, 0x04, 0x07, 0x5a}
+	tcp6 := make([]byte, 36)
+	copy(tcp6, net.ParseIP("2001:db8::1"))
+	copy(tcp6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(tcp6[32:], 1965)
+	binary.BigEndian.PutUint16(tcp6[34:], 1965)
+	tlvs := append(append([]byte{}, tcp4...), 0x04, 0x00, 0x02, 0xaa, 0xbb)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		addr    string
+		invalid bool
+	}{
+		{"v2 TCP over IPv4", proxyProtocolV2Header(0x21, 0x11, tcp4), "192.0.2.1:56324", false},
+		{"v2 TCP over IPv6", proxyProtocolV2Header(0x21, 0x21, tcp6), "[2001:db8::1]:1965", false},
+		{"v2 with TLVs", proxyProtocolV2Header(0x21, 0x11, tlvs), "192.0.2.1:56324", false},
+		{"v2 local", proxyProtocolV2Header(0x20, 0x00, nil), "", false},
+		{"v2 unspecified family", proxyProtocolV2Header(0x21, 0x00, nil), "", false},
+		{"v2 UDP", proxyProtocolV2Header(0x21, 0x12, tcp4), "", false},
+		{"v2 wrong version", proxyProtocolV2Header(0x11, 0x11, tcp4), "", true},
+		{"v2 unknown command", proxyProtocolV2Header(0x22, 0x11, tcp4), "", true},
+		{"v2 short IPv4 addresses", proxyProtocolV2Header(0x21, 0x11, tcp4[:8]), "", true},
+		{"v2 short IPv6 addresses", proxyProtocolV2Header(0x21, 0x21, tcp6[:20]), "", true},
+		{"v2 truncated addresses", proxyProtocolV2Header(0x21, 0x11, tcp4)[:20], "", true},
+		{"v2 truncated header", proxyProtocolSignature[:10], "", true},
+		{"v2 bad signature", append([]byte("\r\n\r\n\x00\rXQUIT\n"), 0x21, 0x11, 0, 12), "", true},
+		{"v1 TCP over IPv4", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 56324 1965\r\n"), "192.0.2.1:56324", false},
+		{"v1 TCP over IPv6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 1965 1965\r\n"), "[2001:db8::1]:1965", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2 198.51.100.7 56324 1965\r\n"), "", true},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 65536 1965\r\n"), "", true},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.1\r\n"), "", true},
+		{"v1 too long", append(append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 120)...), '\r', '\n'), "", true},
+		{"v1 unterminated", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 56324 1965"), "", true},
+		{"missing header", []byte("gemini://example.com/\r\n"), "", true},
+		{"empty", nil, "", true},
+	}
+	for _, test := range tests {
+		reader := bytes.NewReader(append(append([]byte{}, test.header...), "rest"...))
+		addr, err := readProxyProtocolHeader(reader)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got address %v", test.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if test.addr == "" && addr != nil {
+			t.Errorf("%s: expected no address, got %v", test.name, addr)
+		} else if test.addr != "" && (addr == nil || addr.String() != test.addr) {
+			t.Errorf("%s: expected address %s, got %v", test.name, test.addr, addr)
+		}
+		rest, _ := ioutil.ReadAll(reader)
+		if string(rest) != "rest" {
+			t.Errorf("%s: header not read exactly, %q left over", test.name, rest)
+		}
+	}
+}
@@ -17,7 +17,7 @@ type RateLimiter struct {
 	hardLimit int
 }
 
-func newRateLimiter(rate int, softLimit int, hardLimit int) RateLimiter {
+func newRateLimiter(rate int, softLimit int, hardLimit int) *RateLimiter {
 	var rl = new(RateLimiter)
 	rl.bucket = make(map[string]int)
 	rl.bans = make(map[string]time.Time)
@@ -51,7 +51,7 @@ func newRateLimiter(rate int, softLimit int, hardLimit int) RateLimiter {
 			time.Sleep(time.Second)
 		}
 	}()
-	return *rl
+	return rl
 }
 
 func  (rl *RateLimiter) softLimited(addr string) (int, bool) {
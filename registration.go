@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/x509"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+)
+
+// Usernames chosen when registering must be safe to write to group files
+// and to pass to CGI programs.
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,31}$`)
+
+// Registration zones are open to any client certificate which has been
+// registered with a username in the zone's group file.  Clients presenting
+// an unregistered certificate are asked to choose a username, which is
+// added to the file along with the certificate's fingerprint.  The
+// username of the client is returned.
+func handleRegistrationZones(URL *url.URL, clientCerts []*x509.Certificate, config SysConfig, conn net.Conn, logEntry *LogEntry) string {
+	for zone, groupName := range config.RegistrationZones {
+		matched, err := regexp.MatchString(zone, URL.Path)
+		if !matched || err != nil {
+			continue
+		}
+		if len(clientCerts) == 0 {
+			conn.Write([]byte("60 A certificate is required to access this resource\r\n"))
+			logEntry.Status = 60
+			return ""
+		}
+		registered, username := identifyCertificate(clientCerts[0], []string{"group:" + groupName}, config)
+		if registered {
+			return username
+		}
+
+		// Register the certificate with the username given as the query
+		if URL.RawQuery == "" {
+			conn.Write([]byte("10 Choose a username to register your certificate\r\n"))
+			logEntry.Status = 10
+			return ""
+		}
+		username, err = url.QueryUnescape(URL.RawQuery)
+		if err != nil || !validUsername.MatchString(username) {
+			conn.Write([]byte("10 Invalid username, please use up to 32 letters, digits, dots, dashes or underscores\r\n"))
+			logEntry.Status = 10
+			return ""
+		}
+		fingerprint := "sha256:" + getCertFingerprint(clientCerts[0])
+		if config.FingerprintType == "spki" {
+			fingerprint = "spki:" + getPublicKeyFingerprint(clientCerts[0])
+		}
+		group := config.IdentityGroups[groupName]
+		err = group.register(Identity{username, fingerprint}, clientCerts[0], config.FingerprintType)
+		if err == errNameTaken {
+			conn.Write([]byte("10 Username " + username + " is already taken, please choose another\r\n"))
+			logEntry.Status = 10
+			return ""
+		} else if err != nil && err != errAlreadyRegistered {
+			log.Println("Error registering certificate in group file " + group.path + ": " + err.Error())
+			conn.Write([]byte("40 Registration failed!\r\n"))
+			logEntry.Status = 40
+			return ""
+		}
+
+		// If another request from the same certificate registered it first,
+		// there's nothing more to do
+		if err == nil {
+			log.Println("Registered certificate " + fingerprint + " as " + username + " in group file " + group.path + ".")
+		}
+
+		// Send the client back to where they were going
+		URL.RawQuery = ""
+		conn.Write([]byte("30 " + URL.String() + "\r\n"))
+		logEntry.Status = 30
+		return ""
+	}
+	return ""
+}
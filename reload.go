@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Everything which can be changed by reloading the configuration file.
+// Each accepted connection is handled using whichever snapshot was current
+// when it was accepted, so in-flight requests are unaffected by a reload.
+type runningConfig struct {
+	sysConfig  SysConfig
+	userConfig UserConfig
+	certs      ServerCertificates
+	tlsConfig  *tls.Config
+}
+
+func newRunningConfig(sysConfig SysConfig, userConfig UserConfig) (*runningConfig, error) {
+	var rc runningConfig
+	var err error
+	rc.sysConfig = sysConfig
+	rc.userConfig = userConfig
+	rc.certs, err = loadServerCertificates(sysConfig)
+	if err != nil {
+		return nil, err
+	}
+	if sysConfig.ProxyCertPath != "" {
+		proxyCert, err := tls.LoadX509KeyPair(sysConfig.ProxyCertPath, sysConfig.ProxyKeyPath)
+		if err != nil {
+			log.Println("Error loading proxy client keypair: " + err.Error())
+			return nil, err
+		}
+		rc.sysConfig.ProxyCertificate = &proxyCert
+	}
+	rc.tlsConfig = new(tls.Config)
+	rc.tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return rc.certs.get(hello.ServerName), nil
+	}
+	rc.tlsConfig.ClientAuth = tls.RequestClientCert
+	if sysConfig.AllowTLS12 {
+		rc.tlsConfig.MinVersion = tls.VersionTLS12
+	} else {
+		rc.tlsConfig.MinVersion = tls.VersionTLS13
+	}
+	return &rc, nil
+}
+
+// Re-read the configuration file and TLS keypairs used by old.  If anything
+// goes wrong, the error is logged and returned and old should be kept.
+func reloadConfig(old *runningConfig) (*runningConfig, error) {
+	sysConfig, userConfig, err := readConfig(old.sysConfig.ConfigFile, old.sysConfig.WorkingDir)
+	if err != nil {
+		log.Println("Error reading config file " + old.sysConfig.ConfigFile + ": " + err.Error())
+		return nil, err
+	}
+	rc, err := newRunningConfig(sysConfig, userConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Some settings are only used at startup, so warn if they've changed
+	if sysConfig.Port != old.sysConfig.Port {
+		log.Println("Ignoring change of Port to " + strconv.Itoa(sysConfig.Port) + " until restart.")
+	}
+	if sysConfig.ListenFD != old.sysConfig.ListenFD || strings.Join(sysConfig.Listen, " ") != strings.Join(old.sysConfig.Listen, " ") {
+		log.Println("Ignoring change of Listen or ListenFD until restart.")
+	}
+	if strings.Join(sysConfig.ProxyProtocolSources, " ") != strings.Join(old.sysConfig.ProxyProtocolSources, " ") {
+		log.Println("Ignoring change of ProxyProtocolSources until restart.")
+	}
+	if sysConfig.AllowUpgrade != old.sysConfig.AllowUpgrade {
+		log.Println("Ignoring change of AllowUpgrade until restart.")
+	}
+	if sysConfig.AccessLog != old.sysConfig.AccessLog || sysConfig.ErrorLog != old.sysConfig.ErrorLog {
+		log.Println("Ignoring change of AccessLog or ErrorLog until restart.")
+	}
+	if sysConfig.RateLimitAverage != old.sysConfig.RateLimitAverage ||
+		sysConfig.RateLimitSoft != old.sysConfig.RateLimitSoft ||
+		sysConfig.RateLimitHard != old.sysConfig.RateLimitHard {
+		log.Println("Ignoring change of rate limiting parameters until restart.")
+	}
+	if sysConfig.UserCGIAsOwner != old.sysConfig.UserCGIAsOwner ||
+		(sysConfig.UserCGIAsOwner && strings.Join(getHomeDocBases(sysConfig), "\x00") != strings.Join(getHomeDocBases(old.sysConfig), "\x00")) {
+		log.Println("Ignoring change of UserCGIAsOwner or home document bases for the CGI helper until restart.")
+	}
+	if sysConfig.SeccompMode != old.sysConfig.SeccompMode || fmt.Sprint(sysConfig.SeccompAllow) != fmt.Sprint(old.sysConfig.SeccompAllow) {
+		log.Println("Ignoring change of SeccompMode or SeccompAllow until restart.")
+	}
+	return rc, nil
+}
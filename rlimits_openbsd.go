@@ -0,0 +1,9 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// OpenBSD has no RLIMIT_AS, but RLIMIT_DATA covers all anonymous memory
+const rlimitMemory = unix.RLIMIT_DATA
+const rlimitProcesses = unix.RLIMIT_NPROC
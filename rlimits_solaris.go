@@ -0,0 +1,9 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Solaris and illumos have no per-user process limit
+const rlimitMemory = unix.RLIMIT_AS
+const rlimitProcesses = -1
@@ -0,0 +1,11 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd
+// +build aix darwin dragonfly freebsd linux netbsd
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const rlimitMemory = unix.RLIMIT_AS
+const rlimitProcesses = unix.RLIMIT_NPROC
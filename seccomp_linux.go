@@ -0,0 +1,165 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"runtime"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// Groups of system calls which a seccomp filter may allow, named after the
+// pledge(2) promises they roughly correspond to.  "net" covers using
+// sockets which are already open, including passing file descriptors, and
+// connecting sockets; creating them is allowed by the "inet" and "unix"
+// promises in seccompSocketPromises.  Since seccomp filters are inherited
+// across execve(2), "exec" includes some system calls which CGI programs
+// commonly need but molly brown does not.  Names which don't exist on the
+// current architecture are ignored.
+var seccompPromises = map[string]string{
+	"stdio": `read write readv writev pread64 pwrite64 close fstat lseek mmap
+		munmap mprotect madvise mremap brk rt_sigaction rt_sigprocmask
+		rt_sigreturn sigaltstack clone futex sched_yield nanosleep
+		clock_gettime clock_getres clock_nanosleep gettimeofday time
+		gettid getpid getppid tgkill tkill exit exit_group epoll_create
+		epoll_create1 epoll_ctl epoll_wait epoll_pwait epoll_pwait2
+		eventfd2 pipe pipe2 fcntl dup dup2 dup3 getrandom set_robust_list
+		get_robust_list rseq sched_getaffinity uname getrlimit prlimit64
+		restart_syscall getuid geteuid getgid getegid getgroups getresuid
+		getresgid timer_create timer_settime timer_gettime timer_delete
+		setitimer getitimer mincore membarrier arch_prctl set_tid_address
+		poll ppoll select pselect6 fsync fdatasync ioctl`,
+	"net": `connect accept accept4 bind listen getsockname getpeername
+		setsockopt getsockopt shutdown sendto recvfrom sendmsg recvmsg
+		sendmmsg recvmmsg`,
+	"rpath": `open openat openat2 stat lstat newfstatat fstatat statx readlink
+		readlinkat getdents getdents64 access faccessat faccessat2 getcwd
+		statfs fstatfs`,
+	"wpath": `rename renameat renameat2 unlink unlinkat mkdir mkdirat rmdir
+		fchmod fchmodat chmod ftruncate truncate utimensat`,
+	"proc": `clone3 fork vfork wait4 waitid kill setpgid getpgid getpgrp getsid
+		setsid pidfd_open pidfd_send_signal prctl setrlimit close_range
+		getrusage`,
+	"exec": `execve execveat umask chdir fchdir getpriority setpriority sysinfo
+		fadvise64 sched_getparam sched_getscheduler capget`,
+	"restrict": `landlock_create_ruleset landlock_add_rule landlock_restrict_self
+		seccomp`,
+}
+
+// Promises which allow creating sockets, with socket(2) or socketpair(2),
+// only in the address families listed.
+var seccompSocketPromises = map[string][]uint32{
+	"inet": {unix.AF_INET, unix.AF_INET6},
+	"unix": {unix.AF_UNIX},
+}
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetLog          = 0x7ffc0000
+	seccompRetErrno        = 0x00050000
+)
+
+// Install a seccomp filter on every thread, allowing only the system calls
+// belonging to promises and those numbered in extra.  In "log" mode, other
+// system calls are allowed but logged by the kernel, and in "enforce" mode
+// they fail with EPERM.
+func enableSeccomp(mode string, promises []string, extra []int) error {
+	if seccompArch == 0 {
+		return errors.New("Seccomp filtering is not supported on " + runtime.GOARCH)
+	}
+	var defaultAction uint32
+	switch mode {
+	case "log":
+		defaultAction = seccompRetLog
+	case "enforce":
+		defaultAction = seccompRetErrno | uint32(unix.EPERM)
+	default:
+		return errors.New("Invalid SeccompMode " + mode + ", must be log or enforce")
+	}
+
+	allowed := make(map[uintptr]bool)
+	allowedFamilies := make(map[uint32]bool)
+	for _, promise := range promises {
+		for _, name := range strings.Fields(seccompPromises[promise]) {
+			number, ok := seccompSyscalls[name]
+			if ok {
+				allowed[number] = true
+			}
+		}
+		for _, family := range seccompSocketPromises[promise] {
+			allowedFamilies[family] = true
+		}
+	}
+	for _, number := range extra {
+		allowed[uintptr(number)] = true
+	}
+	numbers := make([]int, 0, len(allowed))
+	for number := range allowed {
+		numbers = append(numbers, int(number))
+	}
+	sort.Ints(numbers)
+	families := make([]uint32, 0, len(allowedFamilies))
+	for family := range allowedFamilies {
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i] < families[j] })
+
+	// Check the architecture, then compare the system call number against
+	// each allowed one in turn
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: seccompArch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: defaultAction},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+	}
+	for _, number := range numbers {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: uint32(number)},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow})
+	}
+
+	// Then allow creating sockets in the allowed address families, by
+	// comparing the first argument (the low half of it on these
+	// little-endian architectures) against each of them in turn
+	if len(families) > 0 {
+		for _, name := range []string{"socket", "socketpair"} {
+			number, ok := seccompSyscalls[name]
+			if !ok || allowed[number] {
+				continue
+			}
+			filter = append(filter,
+				unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: uint8(2*len(families) + 2), K: uint32(number)},
+				unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 16})
+			for _, family := range families {
+				filter = append(filter,
+					unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: family},
+					unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow})
+			}
+			filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: defaultAction})
+		}
+	}
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: defaultAction})
+	program := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// The filter is installed on all threads at once, but no_new_privs,
+	// which it requires, only needs setting on the calling thread.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return errors.New("Could not set no_new_privs: " + err.Error())
+	}
+	failed, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&program)))
+	if errno != 0 {
+		return errors.New("Could not install seccomp filter: " + errno.Error())
+	} else if failed != 0 {
+		return errors.New("Could not install seccomp filter on all threads")
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const seccompArch = unix.AUDIT_ARCH_X86_64
+
+// Numbers of the system calls named in seccompPromises which exist on this
+// architecture.
+var seccompSyscalls = map[string]uintptr{
+	"accept":             unix.SYS_ACCEPT,
+	"accept4":            unix.SYS_ACCEPT4,
+	"access":             unix.SYS_ACCESS,
+	"arch_prctl":         unix.SYS_ARCH_PRCTL,
+	"bind":               unix.SYS_BIND,
+	"brk":                unix.SYS_BRK,
+	"capget":             unix.SYS_CAPGET,
+	"chdir":              unix.SYS_CHDIR,
+	"chmod":              unix.SYS_CHMOD,
+	"clock_getres":       unix.SYS_CLOCK_GETRES,
+	"clock_gettime":      unix.SYS_CLOCK_GETTIME,
+	"clock_nanosleep":    unix.SYS_CLOCK_NANOSLEEP,
+	"clone":              unix.SYS_CLONE,
+	"clone3":             unix.SYS_CLONE3,
+	"close":              unix.SYS_CLOSE,
+	"close_range":        unix.SYS_CLOSE_RANGE,
+	"connect":            unix.SYS_CONNECT,
+	"dup":                unix.SYS_DUP,
+	"dup2":               unix.SYS_DUP2,
+	"dup3":               unix.SYS_DUP3,
+	"epoll_create":       unix.SYS_EPOLL_CREATE,
+	"epoll_create1":      unix.SYS_EPOLL_CREATE1,
+	"epoll_ctl":          unix.SYS_EPOLL_CTL,
+	"epoll_pwait":        unix.SYS_EPOLL_PWAIT,
+	"epoll_pwait2":       unix.SYS_EPOLL_PWAIT2,
+	"epoll_wait":         unix.SYS_EPOLL_WAIT,
+	"eventfd2":           unix.SYS_EVENTFD2,
+	"execve":             unix.SYS_EXECVE,
+	"execveat":           unix.SYS_EXECVEAT,
+	"exit":               unix.SYS_EXIT,
+	"exit_group":         unix.SYS_EXIT_GROUP,
+	"faccessat":          unix.SYS_FACCESSAT,
+	"faccessat2":         unix.SYS_FACCESSAT2,
+	"fadvise64":          unix.SYS_FADVISE64,
+	"fchdir":             unix.SYS_FCHDIR,
+	"fchmod":             unix.SYS_FCHMOD,
+	"fchmodat":           unix.SYS_FCHMODAT,
+	"fcntl":              unix.SYS_FCNTL,
+	"fdatasync":          unix.SYS_FDATASYNC,
+	"fork":               unix.SYS_FORK,
+	"fstat":              unix.SYS_FSTAT,
+	"fstatfs":            unix.SYS_FSTATFS,
+	"fsync":              unix.SYS_FSYNC,
+	"ftruncate":          unix.SYS_FTRUNCATE,
+	"futex":              unix.SYS_FUTEX,
+	"get_robust_list":    unix.SYS_GET_ROBUST_LIST,
+	"getcwd":             unix.SYS_GETCWD,
+	"getdents":           unix.SYS_GETDENTS,
+	"getdents64":         unix.SYS_GETDENTS64,
+	"getegid":            unix.SYS_GETEGID,
+	"geteuid":            unix.SYS_GETEUID,
+	"getgid":             unix.SYS_GETGID,
+	"getgroups":          unix.SYS_GETGROUPS,
+	"getitimer":          unix.SYS_GETITIMER,
+	"getpeername":        unix.SYS_GETPEERNAME,
+	"getpgid":            unix.SYS_GETPGID,
+	"getpgrp":            unix.SYS_GETPGRP,
+	"getpid":             unix.SYS_GETPID,
+	"getppid":            unix.SYS_GETPPID,
+	"getpriority":        unix.SYS_GETPRIORITY,
+	"getrandom":          unix.SYS_GETRANDOM,
+	"getresgid":          unix.SYS_GETRESGID,
+	"getresuid":          unix.SYS_GETRESUID,
+	"getrlimit":          unix.SYS_GETRLIMIT,
+	"getrusage":          unix.SYS_GETRUSAGE,
+	"getsid":             unix.SYS_GETSID,
+	"getsockname":        unix.SYS_GETSOCKNAME,
+	"getsockopt":         unix.SYS_GETSOCKOPT,
+	"gettid":             unix.SYS_GETTID,
+	"gettimeofday":       unix.SYS_GETTIMEOFDAY,
+	"getuid":             unix.SYS_GETUID,
+	"ioctl":              unix.SYS_IOCTL,
+	"kill":               unix.SYS_KILL,
+	"listen":             unix.SYS_LISTEN,
+	"lseek":              unix.SYS_LSEEK,
+	"lstat":              unix.SYS_LSTAT,
+	"madvise":            unix.SYS_MADVISE,
+	"membarrier":         unix.SYS_MEMBARRIER,
+	"mincore":            unix.SYS_MINCORE,
+	"mkdir":              unix.SYS_MKDIR,
+	"mkdirat":            unix.SYS_MKDIRAT,
+	"mmap":               unix.SYS_MMAP,
+	"mprotect":           unix.SYS_MPROTECT,
+	"mremap":             unix.SYS_MREMAP,
+	"munmap":             unix.SYS_MUNMAP,
+	"nanosleep":          unix.SYS_NANOSLEEP,
+	"newfstatat":         unix.SYS_NEWFSTATAT,
+	"open":               unix.SYS_OPEN,
+	"openat":             unix.SYS_OPENAT,
+	"openat2":            unix.SYS_OPENAT2,
+	"pidfd_open":         unix.SYS_PIDFD_OPEN,
+	"pidfd_send_signal":  unix.SYS_PIDFD_SEND_SIGNAL,
+	"pipe":               unix.SYS_PIPE,
+	"pipe2":              unix.SYS_PIPE2,
+	"poll":               unix.SYS_POLL,
+	"ppoll":              unix.SYS_PPOLL,
+	"prctl":              unix.SYS_PRCTL,
+	"pread64":            unix.SYS_PREAD64,
+	"prlimit64":          unix.SYS_PRLIMIT64,
+	"pselect6":           unix.SYS_PSELECT6,
+	"pwrite64":           unix.SYS_PWRITE64,
+	"read":               unix.SYS_READ,
+	"readlink":           unix.SYS_READLINK,
+	"readlinkat":         unix.SYS_READLINKAT,
+	"readv":              unix.SYS_READV,
+	"recvfrom":           unix.SYS_RECVFROM,
+	"recvmmsg":           unix.SYS_RECVMMSG,
+	"recvmsg":            unix.SYS_RECVMSG,
+	"rename":             unix.SYS_RENAME,
+	"renameat":           unix.SYS_RENAMEAT,
+	"renameat2":          unix.SYS_RENAMEAT2,
+	"restart_syscall":    unix.SYS_RESTART_SYSCALL,
+	"rmdir":              unix.SYS_RMDIR,
+	"rseq":               unix.SYS_RSEQ,
+	"rt_sigaction":       unix.SYS_RT_SIGACTION,
+	"rt_sigprocmask":     unix.SYS_RT_SIGPROCMASK,
+	"rt_sigreturn":       unix.SYS_RT_SIGRETURN,
+	"sched_getaffinity":  unix.SYS_SCHED_GETAFFINITY,
+	"sched_getparam":     unix.SYS_SCHED_GETPARAM,
+	"sched_getscheduler": unix.SYS_SCHED_GETSCHEDULER,
+	"sched_yield":        unix.SYS_SCHED_YIELD,
+	"select":             unix.SYS_SELECT,
+	"sendmmsg":           unix.SYS_SENDMMSG,
+	"sendmsg":            unix.SYS_SENDMSG,
+	"sendto":             unix.SYS_SENDTO,
+	"set_robust_list":    unix.SYS_SET_ROBUST_LIST,
+	"set_tid_address":    unix.SYS_SET_TID_ADDRESS,
+	"setitimer":          unix.SYS_SETITIMER,
+	"setpgid":            unix.SYS_SETPGID,
+	"setpriority":        unix.SYS_SETPRIORITY,
+	"setrlimit":          unix.SYS_SETRLIMIT,
+	"setsid":             unix.SYS_SETSID,
+	"setsockopt":         unix.SYS_SETSOCKOPT,
+	"shutdown":           unix.SYS_SHUTDOWN,
+	"sigaltstack":        unix.SYS_SIGALTSTACK,
+	"socket":             unix.SYS_SOCKET,
+	"socketpair":         unix.SYS_SOCKETPAIR,
+	"stat":               unix.SYS_STAT,
+	"statfs":             unix.SYS_STATFS,
+	"statx":              unix.SYS_STATX,
+	"sysinfo":            unix.SYS_SYSINFO,
+	"tgkill":             unix.SYS_TGKILL,
+	"time":               unix.SYS_TIME,
+	"timer_create":       unix.SYS_TIMER_CREATE,
+	"timer_delete":       unix.SYS_TIMER_DELETE,
+	"timer_gettime":      unix.SYS_TIMER_GETTIME,
+	"timer_settime":      unix.SYS_TIMER_SETTIME,
+	"tkill":              unix.SYS_TKILL,
+	"truncate":           unix.SYS_TRUNCATE,
+	"umask":              unix.SYS_UMASK,
+	"uname":              unix.SYS_UNAME,
+	"unlink":             unix.SYS_UNLINK,
+	"unlinkat":           unix.SYS_UNLINKAT,
+	"utimensat":          unix.SYS_UTIMENSAT,
+	"vfork":              unix.SYS_VFORK,
+	"wait4":              unix.SYS_WAIT4,
+	"waitid":             unix.SYS_WAITID,
+	"write":              unix.SYS_WRITE,
+	"writev":             unix.SYS_WRITEV,
+
+	// Used by the new process started for an upgrade, which applies its
+	// own restrictions on top of the inherited filter
+	"landlock_add_rule":       unix.SYS_LANDLOCK_ADD_RULE,
+	"landlock_create_ruleset": unix.SYS_LANDLOCK_CREATE_RULESET,
+	"landlock_restrict_self":  unix.SYS_LANDLOCK_RESTRICT_SELF,
+	"seccomp":                 unix.SYS_SECCOMP,
+}
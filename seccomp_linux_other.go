@@ -0,0 +1,9 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package main
+
+// Seccomp filtering is not implemented for this architecture
+const seccompArch = 0
+
+var seccompSyscalls = map[string]uintptr{}
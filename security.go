@@ -1,3 +1,4 @@
+//go:build js || nacl || plan9 || windows
 // +build js nacl plan9 windows
 
 package main
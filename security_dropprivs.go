@@ -1,3 +1,4 @@
+//go:build (linux && go1.16) || aix || darwin || dragonfly || freebsd || illumos || netbsd || openbsd || solaris
 // +build linux,go1.16 aix darwin dragonfly freebsd illumos netbsd openbsd solaris
 
 package main
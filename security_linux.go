@@ -0,0 +1,311 @@
+//go:build linux && go1.16
+// +build linux,go1.16
+
+package main
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	landlockRead  = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockExec  = landlockRead | unix.LANDLOCK_ACCESS_FS_EXECUTE
+	landlockWrite = unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE
+	landlockFile = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_EXECUTE
+	// Every access right known to the first version of Landlock
+	landlockAll = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO | unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM
+)
+
+// System directories which CGI processes need in order to run interpreters,
+// load shared libraries and so on.
+var cgiSystemPaths = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/libx32", "/etc", "/opt"}
+
+// Files needed to look up hostnames of gateways and proxied servers.
+var resolverPaths = []string{"/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf", "/etc/host.conf"}
+
+// Restrict access to the files specified in config in an OS-dependent way.
+// The Linux implementation uses Landlock to restrict the filesystem access
+// available to the molly brown executable, mirroring the OpenBSD unveil(2)
+// restrictions.  Unlike on OpenBSD, the restrictions are inherited by CGI
+// processes, which are additionally allowed to read and execute files in
+// the usual system directories.  If Landlock is unavailable, molly brown
+// continues without it unless RequireLandlock is set.  If SeccompMode is
+// set, a seccomp filter then limits the system calls molly brown and its
+// CGI processes can make.
+func enableSecurityRestrictions(config SysConfig, ui userInfo) error {
+
+	// Setuid to an unprivileged user
+	err := DropPrivs(ui)
+	if err != nil {
+		return err
+	}
+
+	err = enableLandlock(config)
+	if err != nil {
+		if config.RequireLandlock {
+			log.Println("Could not enable Landlock: " + err.Error())
+			return err
+		}
+		log.Println("Continuing without Landlock filesystem restrictions: " + err.Error())
+	}
+
+	if config.SeccompMode == "" || config.SeccompMode == "off" {
+		return nil
+	}
+	err = enableSeccomp(config.SeccompMode, seccompConfigPromises(config), config.SeccompAllow)
+	if err != nil {
+		if config.SeccompMode != "log" {
+			log.Println("Could not enable seccomp filter: " + err.Error())
+			return err
+		}
+		log.Println("Continuing without seccomp filter: " + err.Error())
+		return nil
+	}
+	log.Println("Seccomp filter enabled in " + config.SeccompMode + " mode.")
+	return nil
+}
+
+// Choose the groups of system calls allowed by the seccomp filter, like the
+// pledge(2) promises used on OpenBSD.
+func seccompConfigPromises(config SysConfig) []string {
+	promises := []string{"stdio", "net", "rpath"}
+	unixSockets, inetSockets := getSocketUses(config)
+	if inetSockets {
+		// Gateway applications or proxied servers are reached over TCP,
+		// possibly after looking up their hostnames.
+		promises = append(promises, "inet")
+	}
+	if unixSockets || config.UserCGIAsOwner {
+		// Gateway applications are reached over unix sockets, or the
+		// CGI helper is sent a socket pair for each script it runs.
+		promises = append(promises, "unix")
+	}
+	cgi := len(config.CGIPaths) > 0
+	for _, vhost := range config.VirtualHosts {
+		cgi = cgi || len(vhost.CGIPaths) > 0
+	}
+	if cgi {
+		// CGI processes inherit the filter, so they need to be able to
+		// exec their interpreters as well as be started.
+		promises = append(promises, "proc", "exec")
+	}
+	if len(config.TitanZones) > 0 {
+		promises = append(promises, "wpath")
+	}
+	if config.AllowUpgrade {
+		// The new process started for an upgrade inherits the filter
+		// and applies its own restrictions on top of it, after opening
+		// any new listeners.
+		promises = append(promises, "proc", "exec", "restrict", "inet", "unix")
+	}
+	return promises
+}
+
+func enableLandlock(config SysConfig) error {
+
+	// Check that the kernel supports Landlock at all
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return errors.New("Landlock is not supported by this kernel: " + errno.Error())
+	} else if abi < 1 {
+		return errors.New("Landlock is not supported by this kernel")
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: landlockAll}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errors.New("Could not create Landlock ruleset: " + errno.Error())
+	}
+	ruleset := int(fd)
+	defer unix.Close(ruleset)
+
+	// Allow access to the document bases, CGI paths and SCGI/FastCGI
+	// sockets of the main host and every virtual host.  Document bases must
+	// also be writable if Titan uploads are accepted.
+	docBaseAccess := uint64(landlockRead)
+	if len(config.TitanZones) > 0 {
+		docBaseAccess |= landlockWrite
+	}
+	err := allowHostPaths(ruleset, config.DocBase, docBaseAccess, config.CGIPaths)
+	if err != nil {
+		return err
+	}
+	for _, vhost := range config.VirtualHosts {
+		err = allowHostPaths(ruleset, vhost.DocBase, docBaseAccess, vhost.CGIPaths)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Allow the config file, TLS files, CA files, group files and password
+	// files to be read, so that they can be re-read, and the log files and
+	// group files used for registration to be written.
+	for _, readPath := range getReloadPaths(config) {
+		err = allowPath(ruleset, readPath, landlockRead, "readable")
+		if err != nil {
+			return err
+		}
+	}
+	writePaths := getRegistrationFiles(config)
+	for _, logPath := range []string{config.AccessLog, config.ErrorLog} {
+		if logPath != "" && logPath != "-" {
+			writePaths = append(writePaths, logPath)
+		}
+	}
+	for _, writePath := range writePaths {
+		err = allowPath(ruleset, writePath, unix.LANDLOCK_ACCESS_FS_WRITE_FILE, "writable")
+		if err != nil {
+			return err
+		}
+	}
+
+	// CGI processes need the system directories and /dev/null, and our
+	// own executable if it is used to apply resource limits.
+	cgi := len(config.CGIPaths) > 0
+	tcp := len(config.ProxyPaths) > 0
+	gatewayPaths := []map[string]string{config.SCGIPaths, config.FastCGIPaths}
+	for _, vhost := range config.VirtualHosts {
+		cgi = cgi || len(vhost.CGIPaths) > 0
+		tcp = tcp || len(vhost.ProxyPaths) > 0
+		gatewayPaths = append(gatewayPaths, vhost.SCGIPaths, vhost.FastCGIPaths)
+	}
+	if cgi {
+		for _, systemPath := range cgiSystemPaths {
+			err = allowOptionalPath(ruleset, systemPath, landlockExec, "executable")
+			if err != nil {
+				return err
+			}
+		}
+		err = allowPath(ruleset, os.DevNull, landlockRead|unix.LANDLOCK_ACCESS_FS_WRITE_FILE, "read/write")
+		if err != nil {
+			return err
+		}
+		if getCGILimits(config) != (CGILimits{}) && executablePath != "" {
+			err = allowPath(ruleset, executablePath, landlockExec, "executable")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Upgrades start a new copy of our executable, which may have been
+	// replaced by a new file since we started.
+	if config.AllowUpgrade && executablePath != "" {
+		err = allowPath(ruleset, filepath.Dir(executablePath), landlockExec, "executable")
+		if err != nil {
+			return err
+		}
+	}
+
+	// Hostname lookups for SCGI or FastCGI apps or proxied Gemini servers
+	// reached over TCP need the resolver configuration.  Connecting to
+	// unix domain sockets is not restricted by Landlock.
+	for _, paths := range gatewayPaths {
+		for _, address := range paths {
+			tcp = tcp || strings.HasPrefix(address, "tcp://")
+		}
+	}
+	if tcp {
+		for _, resolverPath := range resolverPaths {
+			err = allowOptionalPath(ruleset, resolverPath, landlockRead, "readable")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Enforce the ruleset on every thread.  This requires that we can't
+	// gain privileges by executing anything.  Go can only make system
+	// calls on every thread of programs which don't use cgo.
+	_, _, errno = syscall.AllThreadsSyscall6(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0, 0)
+	if errno == syscall.ENOTSUP {
+		return errors.New("Landlock requires molly brown to be built with CGO_ENABLED=0")
+	} else if errno != 0 {
+		return errors.New("Could not set no_new_privs: " + errno.Error())
+	}
+	_, _, errno = syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0)
+	if errno != 0 {
+		return errors.New("Could not enforce Landlock ruleset: " + errno.Error())
+	}
+	log.Println("Landlock filesystem restrictions enabled.")
+	return nil
+}
+
+func allowHostPaths(ruleset int, docBase string, docBaseAccess uint64, cgiPaths []string) error {
+
+	// Allow access to the configured document base.
+	description := "readable"
+	if docBaseAccess&unix.LANDLOCK_ACCESS_FS_WRITE_FILE != 0 {
+		description = "read/write"
+	}
+	err := allowPath(ruleset, docBase, docBaseAccess, description)
+	if err != nil {
+		return err
+	}
+
+	// Allow cgi path globs to be executed.
+	for _, cgiPath := range cgiPaths {
+		cgiGlobbedPaths, _ := filepath.Glob(cgiPath)
+		for _, cgiGlobbedPath := range cgiGlobbedPaths {
+			err = allowPath(ruleset, cgiGlobbedPath, landlockExec, "executable")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Like allowPath, but paths which don't exist are skipped.
+func allowOptionalPath(ruleset int, path string, access uint64, description string) error {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return allowPath(ruleset, path, access, description)
+}
+
+// Add a rule to ruleset allowing access to path and, if it is a directory,
+// everything beneath it.
+func allowPath(ruleset int, path string, access uint64, description string) error {
+	log.Println("Allowing \"" + path + "\" as " + description + ".")
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		log.Println("Could not open " + path + " for Landlock rule: " + err.Error())
+		return err
+	}
+	defer unix.Close(fd)
+
+	// Only some access rights make sense for files which aren't directories
+	var stat unix.Stat_t
+	err = unix.Fstat(fd, &stat)
+	if err != nil {
+		return err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFile
+	}
+
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		log.Println("Could not add Landlock rule for " + path + ": " + errno.Error())
+		return errno
+	}
+	return nil
+}
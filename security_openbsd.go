@@ -4,6 +4,7 @@ import (
 	"golang.org/x/sys/unix"
 	"log"
 	"path/filepath"
+	"strings"
 )
 
 // Restrict access to the files specified in config in an OS-dependent way.
@@ -19,32 +20,51 @@ func enableSecurityRestrictions(config SysConfig, ui userInfo) error {
 		return err
 	}
 
-	// Unveil the configured document base as readable.
-	log.Println("Unveiling \"" + config.DocBase + "\" as readable.")
-	err = unix.Unveil(config.DocBase, "r")
+	// Unveil the document bases, CGI paths and SCGI/FastCGI sockets of the
+	// main host and every virtual host.  Document bases must also be writable
+	// if Titan uploads are accepted.
+	docBasePerms := "r"
+	if len(config.TitanZones) > 0 {
+		docBasePerms = "rwc"
+	}
+	err = unveilHostPaths(config.DocBase, docBasePerms, config.CGIPaths, config.SCGIPaths, config.FastCGIPaths)
 	if err != nil {
-		log.Println("Could not unveil DocBase: " + err.Error())
 		return err
 	}
+	for _, vhost := range config.VirtualHosts {
+		err = unveilHostPaths(vhost.DocBase, docBasePerms, vhost.CGIPaths, vhost.SCGIPaths, vhost.FastCGIPaths)
+		if err != nil {
+			return err
+		}
+	}
 
-	// Unveil cgi path globs as executable.
-	for _, cgiPath := range config.CGIPaths {
-		cgiGlobbedPaths, err := filepath.Glob(cgiPath)
-		for _, cgiGlobbedPath := range cgiGlobbedPaths {
-			log.Println("Unveiling \"" + cgiGlobbedPath + "\" as executable.")
-			err = unix.Unveil(cgiGlobbedPath, "rx")
-			if err != nil {
-				log.Println("Could not unveil CGIPaths: " + err.Error())
-				return err
-			}
+	// Unveil the config file, TLS files, CA files, group files and
+	// password files as readable, so that they can be re-read, and group
+	// files used for registration as writable.
+	for _, reloadPath := range getReloadPaths(config) {
+		log.Println("Unveiling \"" + reloadPath + "\" as readable.")
+		err = unix.Unveil(reloadPath, "r")
+		if err != nil {
+			log.Println("Could not unveil config, TLS, CA, group or password file: " + err.Error())
+			return err
+		}
+	}
+	for _, registrationFile := range getRegistrationFiles(config) {
+		log.Println("Unveiling \"" + registrationFile + "\" as read/write.")
+		err = unix.Unveil(registrationFile, "rw")
+		if err != nil {
+			log.Println("Could not unveil group file: " + err.Error())
+			return err
 		}
 	}
 
-	// Unveil scgi socket paths as readable and writeable.
-	for _, scgiSocket := range config.SCGIPaths {
-		log.Println("Unveiling \"" + scgiSocket + "\" as read/write.")
-		err = unix.Unveil(scgiSocket, "rw")
+	// Unveil our own executable, if it is needed to apply resource
+	// limits to CGI processes or to start a new process for an upgrade.
+	if (getCGILimits(config) != (CGILimits{}) || config.AllowUpgrade) && executablePath != "" {
+		log.Println("Unveiling \"" + executablePath + "\" as executable.")
+		err = unix.Unveil(executablePath, "rx")
 		if err != nil {
+			log.Println("Could not unveil molly brown executable: " + err.Error())
 			return err
 		}
 	}
@@ -59,14 +79,38 @@ func enableSecurityRestrictions(config SysConfig, ui userInfo) error {
 
 	// Pledge to only use stdio, inet, and rpath syscalls.
 	promises := "stdio inet rpath"
-	if len(config.CGIPaths) > 0 {
-		// If CGI paths have been specified, also allow exec syscalls.
+	cgi := len(config.CGIPaths) > 0
+	for _, vhost := range config.VirtualHosts {
+		cgi = cgi || len(vhost.CGIPaths) > 0
+	}
+	unixSockets, tcpGateway := getSocketUses(config)
+	if cgi || config.AllowUpgrade {
+		// If CGI paths have been specified or upgrades are allowed, also
+		// allow exec syscalls.
 		promises += " exec proc"
 	}
-	if len(config.SCGIPaths) > 0 {
-		// If SCGI paths have been specified, also allow unix sockets.
+	if unixSockets {
+		// If SCGI or FastCGI sockets have been specified, or we're
+		// listening on a unix socket, also allow unix sockets.
 		promises += " unix"
 	}
+	if tcpGateway {
+		// If SCGI or FastCGI apps or proxied Gemini servers are reached
+		// over TCP, also allow hostname lookups.
+		promises += " dns"
+	}
+	if config.UserCGIAsOwner {
+		// If user CGI scripts are run by the CGI helper, also allow
+		// passing file descriptors to it.
+		promises += " sendfd"
+	}
+	if len(config.TitanZones) > 0 {
+		// If Titan uploads are accepted, also allow writing files.
+		promises += " wpath cpath fattr"
+	} else if len(config.RegistrationZones) > 0 {
+		// If clients can register, also allow writing group files.
+		promises += " wpath"
+	}
 	err = unix.PledgePromises(promises)
 	if err != nil {
 		log.Println("Could not pledge: " + err.Error())
@@ -75,3 +119,43 @@ func enableSecurityRestrictions(config SysConfig, ui userInfo) error {
 
 	return nil
 }
+
+func unveilHostPaths(docBase string, docBasePerms string, cgiPaths []string, gatewayPaths ...map[string]string) error {
+
+	// Unveil the configured document base as readable.
+	log.Println("Unveiling \"" + docBase + "\" as \"" + docBasePerms + "\".")
+	err := unix.Unveil(docBase, docBasePerms)
+	if err != nil {
+		log.Println("Could not unveil DocBase: " + err.Error())
+		return err
+	}
+
+	// Unveil cgi path globs as executable.
+	for _, cgiPath := range cgiPaths {
+		cgiGlobbedPaths, err := filepath.Glob(cgiPath)
+		for _, cgiGlobbedPath := range cgiGlobbedPaths {
+			log.Println("Unveiling \"" + cgiGlobbedPath + "\" as executable.")
+			err = unix.Unveil(cgiGlobbedPath, "rx")
+			if err != nil {
+				log.Println("Could not unveil CGIPaths: " + err.Error())
+				return err
+			}
+		}
+	}
+
+	// Unveil scgi and fastcgi socket paths as readable and writeable.
+	for _, paths := range gatewayPaths {
+		for _, socket := range paths {
+			if strings.HasPrefix(socket, "tcp://") {
+				continue
+			}
+			log.Println("Unveiling \"" + socket + "\" as read/write.")
+			err = unix.Unveil(socket, "rw")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
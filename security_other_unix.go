@@ -1,4 +1,5 @@
-// +build linux,go1.16 aix darwin dragonfly freebsd illumos netbsd solaris
+//go:build aix || darwin || dragonfly || freebsd || illumos || netbsd || solaris
+// +build aix darwin dragonfly freebsd illumos netbsd solaris
 
 package main
 
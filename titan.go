@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TitanUpload struct {
+	Size  int64
+	Mime  string
+	Token string
+	Body  io.Reader
+}
+
+// Strip the ;size=, ;mime= and ;token= parameters of a Titan request from
+// the end of URL's path.  The upload body is whatever follows the request
+// line in reader.
+func parseTitanParameters(URL *url.URL, reader io.Reader) (*TitanUpload, error) {
+	var upload TitanUpload
+	upload.Size = -1
+	upload.Body = reader
+
+	bits := strings.Split(URL.Path, ";")
+	URL.Path = bits[0]
+	URL.RawPath = ""
+	for _, param := range bits[1:] {
+		keyValue := strings.SplitN(param, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, errors.New("Malformed Titan parameter " + param)
+		}
+		value, err := url.PathUnescape(keyValue[1])
+		if err != nil {
+			return nil, err
+		}
+		switch keyValue[0] {
+		case "size":
+			upload.Size, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || upload.Size < 0 {
+				return nil, errors.New("Invalid Titan size " + value)
+			}
+		case "mime":
+			upload.Mime = value
+		case "token":
+			upload.Token = value
+		}
+	}
+	if upload.Size == -1 {
+		return nil, errors.New("Missing Titan size parameter")
+	}
+	if upload.Mime == "" {
+		upload.Mime = "text/gemini"
+	}
+	return &upload, nil
+}
+
+func handleTitan(URL *url.URL, upload *TitanUpload, clientCerts []*x509.Certificate, config SysConfig, logEntry *LogEntry, conn net.Conn) {
+	// Only accept uploads for paths in a Titan zone, from an authorised
+	// certificate
+	matched := false
+	authorised := false
+	remoteUser := ""
+	for zone, allowedFingerprints := range config.TitanZones {
+		zoneMatched, err := regexp.MatchString(zone, URL.Path)
+		if !zoneMatched || err != nil {
+			continue
+		}
+		matched = true
+		if len(clientCerts) == 0 {
+			continue
+		}
+		authorised, remoteUser = identifyCertificate(clientCerts[0], allowedFingerprints, config)
+		if authorised {
+			break
+		}
+	}
+	if !matched {
+		conn.Write([]byte("59 Uploads are not accepted for this resource!\r\n"))
+		logEntry.Status = 59
+		return
+	} else if !authorised && len(clientCerts) == 0 {
+		conn.Write([]byte("60 A pre-authorised certificate is required to upload to this resource\r\n"))
+		logEntry.Status = 60
+		return
+	} else if !authorised {
+		conn.Write([]byte("61 Provided certificate not authorised to upload to this resource\r\n"))
+		logEntry.Status = 61
+		return
+	}
+	if upload.Size > config.TitanMaxSize {
+		conn.Write([]byte("59 Upload exceeds maximum size of " + strconv.FormatInt(config.TitanMaxSize, 10) + " bytes!\r\n"))
+		logEntry.Status = 59
+		return
+	}
+
+	// Allow the same generous time for receiving the upload as serveFile
+	// does for sending files
+	allowedTime := int(upload.Size / 512)
+	if allowedTime < 30 {
+		allowedTime = 30
+	}
+	err := conn.SetReadDeadline(time.Now().Add(time.Duration(allowedTime) * time.Second))
+	if err != nil {
+		log.Println("Error setting read deadline: " + err.Error())
+		conn.Write([]byte("40 Error!\r\n"))
+		logEntry.Status = 40
+		return
+	}
+
+	// Uploads to CGI scripts are passed to them on stdin, and uploads to
+	// anywhere else in a CGI path are never written to disk
+	path := resolvePath(URL.Path, config)
+	inCGIPath := false
+	for _, cgiPath := range config.CGIPaths {
+		if strings.HasPrefix(path, cgiPath) {
+			inCGIPath = true
+			handleCGI(config, path, cgiPath, URL, upload, remoteUser, logEntry, conn)
+			if logEntry.Status != 0 {
+				return
+			}
+		}
+	}
+	if inCGIPath {
+		conn.Write([]byte("51 Not found!\r\n"))
+		logEntry.Status = 51
+		return
+	}
+
+	// If symbolic links have been used to escape the intended document
+	// directory, deny all knowledge
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		conn.Write([]byte("51 Not found!\r\n"))
+		logEntry.Status = 51
+		return
+	}
+	isSub, err := isSubdir(dir, config.DocBase)
+	if err != nil {
+		log.Println("Error testing whether path " + dir + " is below DocBase: " + err.Error())
+	}
+	if !isSub {
+		log.Println("Refusing to follow symlink from " + path + " outside of DocBase!")
+	}
+	if err != nil || !isSub {
+		conn.Write([]byte("51 Not found!\r\n"))
+		logEntry.Status = 51
+		return
+	}
+	path = filepath.Join(dir, filepath.Base(path))
+
+	// Refuse to overwrite sensitive files, or anything which isn't a plain
+	// file
+	if isProtectedFile(path, config) {
+		conn.Write([]byte("59 Uploads are not accepted for this resource!\r\n"))
+		logEntry.Status = 59
+		return
+	}
+	info, err := os.Lstat(path)
+	if err == nil && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+		conn.Write([]byte("59 Uploads are not accepted for this resource!\r\n"))
+		logEntry.Status = 59
+		return
+	}
+
+	// An empty upload is a request for deletion
+	if upload.Size == 0 {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("Error deleting file " + path + ": " + err.Error())
+			conn.Write([]byte("40 Error deleting file!\r\n"))
+			logEntry.Status = 40
+			return
+		}
+		redirectToUpload(URL, logEntry, conn)
+		return
+	}
+
+	err = writeUpload(path, upload)
+	if err != nil {
+		log.Println("Error writing upload to " + path + ": " + err.Error())
+		conn.Write([]byte("40 Error writing upload!\r\n"))
+		logEntry.Status = 40
+		return
+	}
+	redirectToUpload(URL, logEntry, conn)
+}
+
+// Report whether path is one of the files the server reads its
+// configuration, certificates or credentials from or writes its logs to, or
+// a .molly file.
+func isProtectedFile(path string, config SysConfig) bool {
+	if filepath.Base(path) == ".molly" {
+		return true
+	}
+	protectedPaths := append(getReloadPaths(config), config.AccessLog, config.ErrorLog)
+	for _, protectedPath := range protectedPaths {
+		if protectedPath == "" {
+			continue
+		}
+		realPath, err := filepath.EvalSymlinks(protectedPath)
+		if path == protectedPath || (err == nil && path == realPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write upload to a temporary file alongside path and rename it into place,
+// so that clients never see a partially written file.
+func writeUpload(path string, upload *TitanUpload) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".titan-upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = io.CopyN(tmpFile, upload.Body, upload.Size)
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err != nil {
+		return err
+	} else if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+func redirectToUpload(URL *url.URL, logEntry *LogEntry, conn net.Conn) {
+	URL.Scheme = "gemini"
+	conn.Write([]byte("30 " + URL.String() + "\r\n"))
+	logEntry.Status = 30
+}
+
+func prepareTitanVariables(vars map[string]string, upload *TitanUpload) {
+	vars["SERVER_PROTOCOL"] = "TITAN"
+	vars["CONTENT_LENGTH"] = strconv.FormatInt(upload.Size, 10)
+	vars["CONTENT_TYPE"] = upload.Mime
+	if upload.Token != "" {
+		vars["TITAN_TOKEN"] = upload.Token
+	}
+}
@@ -0,0 +1,20 @@
+//go:build js || nacl || plan9 || windows
+// +build js nacl plan9 windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+func notifyUpgradeSignal(c chan<- os.Signal) {
+}
+
+func startUpgrade(listeners []net.Listener, workingDir string) error {
+	return errors.New("Upgrades are not supported on this platform")
+}
+
+func signalReady() {
+}
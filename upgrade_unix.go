@@ -0,0 +1,123 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd illumos linux netbsd openbsd solaris
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long to wait for a new process started for an upgrade to be ready.
+const upgradeTimeout = 30 * time.Second
+
+func notifyUpgradeSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// Start a new molly brown process with the same arguments and working
+// directory, handing it listeners, and wait for it to be ready to accept
+// connections.  The new process finds the listeners with
+// inheritedListenerFDs, and signals that it is ready by writing to a pipe
+// whose file descriptor it is given in MOLLY_READY_FD.
+func startUpgrade(listeners []net.Listener, workingDir string) error {
+	if executablePath == "" {
+		return errors.New("Could not find molly brown executable")
+	}
+
+	// The listeners' file descriptors are passed on directly, as getting
+	// them via File would put the sockets, which we're still accepting
+	// connections on, into blocking mode.
+	files := []uintptr{0, 1, 2}
+	for _, listener := range listeners {
+		conn, ok := listener.(syscall.Conn)
+		if !ok {
+			return errors.New("Could not hand over listener on " + listener.Addr().String())
+		}
+		rawConn, err := conn.SyscallConn()
+		if err == nil {
+			err = rawConn.Control(func(fd uintptr) {
+				files = append(files, fd)
+			})
+		}
+		if err != nil {
+			return errors.New("Could not hand over listener on " + listener.Addr().String() + ": " + err.Error())
+		}
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, readyWriter.Fd())
+
+	env := []string{
+		"MOLLY_LISTEN_FDS=" + strconv.Itoa(len(listeners)),
+		"MOLLY_READY_FD=" + strconv.Itoa(listenFDsStart+len(listeners)),
+	}
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, "MOLLY_LISTEN_FDS=") && !strings.HasPrefix(variable, "MOLLY_READY_FD=") {
+			env = append(env, variable)
+		}
+	}
+	pid, err := syscall.ForkExec(executablePath, os.Args, &syscall.ProcAttr{
+		Dir:   workingDir,
+		Env:   env,
+		Files: files,
+	})
+	readyWriter.Close()
+	if err != nil {
+		return errors.New("Could not start new process: " + err.Error())
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	// Wait for the new process to write to the pipe.  If it exits first,
+	// or takes too long, give up on it.
+	ready.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	_, err = ready.Read(make([]byte, 1))
+	if err != nil {
+		process.Kill()
+		go process.Wait()
+		return errors.New("New process did not become ready: " + err.Error())
+	}
+
+	// The new process is now responsible for unix sockets
+	for _, listener := range listeners {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
+
+// Find the file descriptor of the pipe used to signal readiness to the
+// process which started us for an upgrade, or -1 if there is none.
+func upgradeReadyFD() int {
+	fd, err := strconv.Atoi(os.Getenv("MOLLY_READY_FD"))
+	if err != nil || fd < listenFDsStart {
+		return -1
+	}
+	return fd
+}
+
+// Tell the process which started us for an upgrade, if any, that we are
+// accepting connections.
+func signalReady() {
+	fd := upgradeReadyFD()
+	os.Unsetenv("MOLLY_READY_FD")
+	if fd < 0 {
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}